@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aphistic/docfs/dfs"
+	"github.com/aphistic/docfs/dfs/db"
+	"github.com/urfave/cli"
+)
+
+// openAdminDb opens the database of an existing docfs root. Opening a
+// database creates it if it's missing, so the root is checked first to
+// avoid leaving an empty database in a directory that isn't a docfs root.
+func openAdminDb(c *cli.Context, docRoot string) (*db.DB, error) {
+	enableDebug(c)
+
+	dbPath := path.Join(docRoot, "docfs.db")
+	_, err := os.Stat(dbPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("'%s' is not a docfs root, create one with docfs init",
+			docRoot)
+	} else if err != nil {
+		return nil, fmt.Errorf("docfs root '%s' could not be opened: %s",
+			docRoot, err)
+	}
+
+	dfs.Debug(fmt.Sprintf("opening database %s", dbPath))
+	fsdb, err := db.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("docfs root '%s' could not be opened: %s",
+			docRoot, err)
+	}
+
+	return fsdb, nil
+}
+
+func runAdminTags(c *cli.Context) error {
+	err := requireArgs(c, 1)
+	if err != nil {
+		return err
+	}
+
+	fsdb, err := openAdminDb(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer fsdb.Close()
+
+	tags, err := fsdb.GetTags()
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		fmt.Printf("%d\t%s\n", tag.ID, tag.Path)
+	}
+
+	return nil
+}
+
+func runAdminAddTag(c *cli.Context) error {
+	err := requireArgs(c, 2)
+	if err != nil {
+		return err
+	}
+
+	fsdb, err := openAdminDb(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer fsdb.Close()
+
+	_, err = fsdb.AddTagPath(c.Args().Get(1))
+	return err
+}
+
+func runAdminRemoveTag(c *cli.Context) error {
+	err := requireArgs(c, 2)
+	if err != nil {
+		return err
+	}
+
+	fsdb, err := openAdminDb(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer fsdb.Close()
+
+	tag, err := fsdb.GetTagByPath(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	return fsdb.RemoveTag(tag.ParentID, tag.Name, time.Now())
+}
+
+func runAdminDocs(c *cli.Context) error {
+	err := requireArgs(c, 1)
+	if err != nil {
+		return err
+	}
+
+	fsdb, err := openAdminDb(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer fsdb.Close()
+
+	years, err := fsdb.GetYears()
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		months, err := fsdb.GetMonths(year)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			days, err := fsdb.GetDays(year, month)
+			if err != nil {
+				return err
+			}
+			for _, day := range days {
+				docs, err := fsdb.GetDocs(year, month, day)
+				if err != nil {
+					return err
+				}
+				for _, doc := range docs {
+					fmt.Printf("%d\t%04d/%02d/%02d\t%s\t%s\n",
+						doc.ID, doc.Year, doc.Month, doc.Day,
+						doc.Checksum, doc.Filename)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package dfs
+
+import (
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// dirAttr fills in the attributes of a directory with the given number of
+// child directories. Directories aren't stored anywhere so their times are
+// the time the filesystem was mounted.
+func (f *DocFS) dirAttr(attr *fuse.Attr, inode uint64, perm os.FileMode, subdirs int) {
+	attr.Inode = inode
+	attr.Mode = os.ModeDir | perm
+	attr.Nlink = uint32(2 + subdirs)
+	attr.Uid = f.uid
+	attr.Gid = f.gid
+	attr.Atime = f.mounted
+	attr.Mtime = f.mounted
+	attr.Ctime = f.mounted
+	attr.Crtime = f.mounted
+}
+
+// fileAttr fills in the attributes of a file that was last written at mtime
+// and created at crtime.
+func (f *DocFS) fileAttr(attr *fuse.Attr, inode uint64, perm os.FileMode, size int64, mtime time.Time, crtime time.Time) {
+	attr.Inode = inode
+	attr.Mode = perm
+	attr.Nlink = 1
+	attr.Size = uint64(size)
+	attr.Blocks = uint64((size + 511) / 512)
+	attr.Uid = f.uid
+	attr.Gid = f.gid
+	attr.Atime = mtime
+	attr.Mtime = mtime
+	attr.Ctime = mtime
+	attr.Crtime = crtime
+}
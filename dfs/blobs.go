@@ -0,0 +1,85 @@
+package dfs
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+// blobStore keeps document contents in files named after the SHA-256 of
+// their contents, so identical documents share a single file. Blobs are
+// sharded into directories by the first bytes of their hash to keep
+// directory sizes down.
+//
+// The blob store doesn't know which documents use a blob, callers need to
+// hold the lock while checking references and adding or removing blobs.
+type blobStore struct {
+	sync.Mutex
+
+	root string
+}
+
+func newBlobStore(root string) *blobStore {
+	return &blobStore{
+		root: root,
+	}
+}
+
+func (b *blobStore) path(hash string) string {
+	return path.Join(b.root, hash[0:2], hash[2:4], hash)
+}
+
+func (b *blobStore) exists(hash string) (bool, error) {
+	_, err := os.Stat(b.path(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// put moves the file at srcPath into the store as the blob for hash. If
+// the blob is already stored srcPath is left where it is. The returned bool
+// is true if srcPath was moved into the store.
+func (b *blobStore) put(srcPath string, hash string) (bool, error) {
+	exists, err := b.exists(hash)
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		return false, nil
+	}
+
+	blobPath := b.path(hash)
+	err = os.MkdirAll(path.Dir(blobPath), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(srcPath, blobPath)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (b *blobStore) open(hash string) (*os.File, error) {
+	return os.Open(b.path(hash))
+}
+
+func (b *blobStore) stat(hash string) (os.FileInfo, error) {
+	return os.Stat(b.path(hash))
+}
+
+func (b *blobStore) remove(hash string) error {
+	err := os.Remove(b.path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -2,13 +2,13 @@ package dfs
 
 import (
 	"fmt"
-	"os"
 	"strconv"
 
 	"time"
 
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
 	"golang.org/x/net/context"
 )
 
@@ -25,18 +25,29 @@ func mergedDateKey(year uint64, month uint64, day uint64) uint64 {
 }
 
 func newFsYear(fs *DocFS, year uint64) *fsYear {
-	y := &fsYear{
-		fs:   fs,
-		Year: year,
-	}
-	y.inode = fs.getInode(nYear, uint64(year))
-	y.name = fmt.Sprintf("%d", year)
-	return y
+	inode := fs.getInode(nYear, year)
+	return fs.getNode(inode, func() fusefs.Node {
+		y := &fsYear{
+			fs:   fs,
+			Year: year,
+		}
+		y.inode = inode
+		y.name = fmt.Sprintf("%d", year)
+		return y
+	}).(*fsYear)
+}
+
+func (y *fsYear) Forget() {
+	y.fs.forgetNode(y.inode, y)
 }
 
 func (y *fsYear) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = y.inode
-	attr.Mode = os.ModeDir | 0755
+	months, err := y.fs.fsdb.GetMonths(y.Year)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	y.fs.dirAttr(attr, y.inode, 0755, len(months))
 	return nil
 }
 
@@ -45,7 +56,7 @@ func (y *fsYear) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 	months, err := y.fs.fsdb.GetMonths(y.Year)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	for _, month := range months {
@@ -66,7 +77,7 @@ func (y *fsYear) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
 
 	month, err = y.fs.fsdb.GetMonth(y.Year, month)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuseError(err)
 	}
 
 	return newFsMonth(y.fs, y.Year, month), nil
@@ -75,16 +86,16 @@ func (y *fsYear) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
 func (y *fsYear) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
 	month, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return nil, fuse.EPERM
+		return nil, errInvalid
 	}
 
 	if month < 1 || month > 12 {
-		return nil, fuse.EPERM
+		return nil, errInvalid
 	}
 
 	err = y.fs.fsdb.AddMonth(y.Year, month)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	return newFsMonth(y.fs, y.Year, month), nil
@@ -92,20 +103,16 @@ func (y *fsYear) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node
 
 func (y *fsYear) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if !req.Dir {
-		return fuse.EIO
+		return errIsDir
 	}
 
 	month, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return fuse.EIO
+		return fuse.ENOENT
 	}
 
-	err = y.fs.fsdb.RemoveMonth(y.Year, month)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	err = y.fs.fsdb.RemoveMonth(y.Year, month, y.fs.cascadeRemove, y.fs.clock.Now())
+	return fuseError(err)
 }
 
 type fsMonth struct {
@@ -118,19 +125,30 @@ type fsMonth struct {
 }
 
 func newFsMonth(fs *DocFS, year uint64, month uint64) *fsMonth {
-	m := &fsMonth{
-		fs:    fs,
-		Year:  year,
-		Month: month,
-	}
-	m.inode = fs.getInode(nMonth, mergedDateKey(m.Year, m.Month, 0))
-	m.name = fmt.Sprintf("%02d", month)
-	return m
+	inode := fs.getInode(nMonth, mergedDateKey(year, month, 0))
+	return fs.getNode(inode, func() fusefs.Node {
+		m := &fsMonth{
+			fs:    fs,
+			Year:  year,
+			Month: month,
+		}
+		m.inode = inode
+		m.name = fmt.Sprintf("%02d", month)
+		return m
+	}).(*fsMonth)
+}
+
+func (m *fsMonth) Forget() {
+	m.fs.forgetNode(m.inode, m)
 }
 
 func (m *fsMonth) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = m.inode
-	attr.Mode = os.ModeDir | 0755
+	days, err := m.fs.fsdb.GetDays(m.Year, m.Month)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	m.fs.dirAttr(attr, m.inode, 0755, len(days))
 	return nil
 }
 
@@ -139,7 +157,7 @@ func (m *fsMonth) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 	days, err := m.fs.fsdb.GetDays(m.Year, m.Month)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	for _, day := range days {
@@ -160,7 +178,7 @@ func (m *fsMonth) Lookup(ctx context.Context, name string) (fusefs.Node, error)
 
 	day, err = m.fs.fsdb.GetDay(m.Year, m.Month, day)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuseError(err)
 	}
 
 	return newFsDay(m.fs, m.Year, m.Month, day), nil
@@ -169,19 +187,19 @@ func (m *fsMonth) Lookup(ctx context.Context, name string) (fusefs.Node, error)
 func (m *fsMonth) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
 	day, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return nil, fuse.EPERM
+		return nil, errInvalid
 	}
 
 	nextMonth := time.Date(int(m.Year), time.Month(m.Month+1), 1, 0, 0, 0, 0, time.UTC)
 	lastDay := nextMonth.Add(-1 * time.Hour)
 
 	if day < 1 || int(day) > lastDay.Day() {
-		return nil, fuse.EPERM
+		return nil, errInvalid
 	}
 
 	err = m.fs.fsdb.AddDay(m.Year, m.Month, day)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	return newFsDay(m.fs, m.Year, m.Month, day), nil
@@ -189,20 +207,16 @@ func (m *fsMonth) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Nod
 
 func (m *fsMonth) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if !req.Dir {
-		return fuse.EIO
+		return errIsDir
 	}
 
 	day, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return fuse.EIO
+		return fuse.ENOENT
 	}
 
-	err = m.fs.fsdb.RemoveDay(m.Year, m.Month, day)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	err = m.fs.fsdb.RemoveDay(m.Year, m.Month, day, m.fs.cascadeRemove, m.fs.clock.Now())
+	return fuseError(err)
 }
 
 type fsDay struct {
@@ -216,48 +230,130 @@ type fsDay struct {
 }
 
 func newFsDay(fs *DocFS, year uint64, month uint64, day uint64) *fsDay {
-	d := &fsDay{
-		fs:    fs,
-		Year:  year,
-		Month: month,
-		Day:   day,
-	}
-	d.inode = fs.getInode(nDay, mergedDateKey(d.Year, d.Month, day))
-	d.name = fmt.Sprintf("%02d", day)
-	return d
+	inode := fs.getInode(nDay, mergedDateKey(year, month, day))
+	return fs.getNode(inode, func() fusefs.Node {
+		d := &fsDay{
+			fs:    fs,
+			Year:  year,
+			Month: month,
+			Day:   day,
+		}
+		d.inode = inode
+		d.name = fmt.Sprintf("%02d", day)
+		return d
+	}).(*fsDay)
+}
+
+func (d *fsDay) Forget() {
+	d.fs.forgetNode(d.inode, d)
 }
 
 func (d *fsDay) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = d.inode
-	attr.Mode = os.ModeDir | 0755
+	d.fs.dirAttr(attr, d.inode, 0755, 0)
 	return nil
 }
 
 func (d *fsDay) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	var children []fuse.Dirent
+
+	docs, err := d.fs.fsdb.GetDocs(d.Year, d.Month, d.Day)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  doc.Filename,
+			Inode: d.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	for _, s := range d.fs.getScratches(d.Year, d.Month, d.Day) {
+		children = append(children, fuse.Dirent{
+			Name:  s.name,
+			Inode: s.inode,
+			Type:  fuse.DT_File,
+		})
+	}
+
 	return children, nil
 }
 
-func (d *fsDay) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
-	return nil, fuse.ENOENT
+func (d *fsDay) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fusefs.Node, error) {
+	// Documents still being written aren't in the database yet. They
+	// only exist until they're closed so the kernel shouldn't cache them.
+	if s := d.fs.getScratch(d.Year, d.Month, d.Day, req.Name); s != nil {
+		resp.EntryValid = 0
+		return s, nil
+	}
+
+	getDoc := func(name string) (*db.Doc, error) {
+		return d.fs.fsdb.GetDocByName(d.Year, d.Month, d.Day, name)
+	}
+	if revs, ok, err := lookupRevisions(d.fs, req.Name, getDoc); ok {
+		return revs, fuseError(err)
+	}
+
+	doc, err := getDoc(req.Name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsDoc(d.fs, doc.ID, doc.Filename), nil
+}
+
+// Remove moves a document to the trash.
+func (d *fsDay) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return fuse.ENOENT
+	}
+
+	doc, err := d.fs.fsdb.GetDocByName(d.Year, d.Month, d.Day, req.Name)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	return fuseError(d.fs.fsdb.TrashDoc(doc.ID, d.fs.clock.Now()))
 }
 
-func (d *fsDay) Create(ctx context.Context, req *fuse.CreateRequest, res *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
-	curTime := d.fs.clock.Now()
+// Rename renames a document, or re-dates it when it's moved to another day.
+// A document already there with the new name is moved to the trash.
+func (d *fsDay) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	target, ok := newDir.(*fsDay)
+	if !ok {
+		return fuse.EPERM
+	}
 
-	y := curTime.Year()
-	m := int(curTime.Month())
-	day := curTime.Day()
+	// Documents still being written get their name and date when they're
+	// promoted, so they can't be moved until then.
+	if d.fs.getScratch(d.Year, d.Month, d.Day, req.OldName) != nil {
+		return errBusy
+	}
 
-	sID, err := d.fs.fsdb.CreateScratch(req.Name, y, m, day, curTime)
+	doc, err := d.fs.fsdb.GetDocByName(d.Year, d.Month, d.Day, req.OldName)
 	if err != nil {
-		return nil, nil, fuse.ENOENT
+		return fuseError(err)
 	}
-	doc := newScratchDoc(d.fs, sID)
-	err = doc.Open()
+
+	err = d.fs.fsdb.MoveDoc(
+		doc.ID, target.Year, target.Month, target.Day, req.NewName,
+		d.fs.clock.Now(),
+	)
+	return fuseError(err)
+}
+
+func (d *fsDay) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	doc, err := createScratchDoc(d.fs, req.Name, d.Year, d.Month, d.Day, 0)
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
+
+	handle, err := doc.newHandle()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fuseError(err)
 	}
 
-	return doc, doc, nil
+	resp.EntryValid = 0
+	return doc, handle, nil
 }
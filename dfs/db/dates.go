@@ -1,11 +1,16 @@
 package db
 
+import (
+	"database/sql"
+	"time"
+)
+
 // Years
 
 func (d *DB) GetYears() ([]uint64, error) {
 	res, err := d.d.Query("SELECT year FROM year;")
 	if err != nil {
-		return nil, err
+		return nil, translateErr(err)
 	}
 	defer res.Close()
 
@@ -14,7 +19,7 @@ func (d *DB) GetYears() ([]uint64, error) {
 		var year uint64
 		err = res.Scan(&year)
 		if err != nil {
-			return nil, err
+			return nil, translateErr(err)
 		}
 		years = append(years, year)
 	}
@@ -25,7 +30,7 @@ func (d *DB) GetYears() ([]uint64, error) {
 func (d *DB) GetYear(year uint64) (uint64, error) {
 	res, err := d.d.Query("SELECT year FROM year WHERE year == ?", year)
 	if err != nil {
-		return 0, err
+		return 0, translateErr(err)
 	}
 	defer res.Close()
 
@@ -37,37 +42,45 @@ func (d *DB) GetYear(year uint64) (uint64, error) {
 }
 
 func (d *DB) AddYear(year uint64) error {
-	res, err := d.d.Query("SELECT year FROM year WHERE year == ?", year)
+	return d.withTx(func(tx *sql.Tx) error {
+		return addYear(tx, year)
+	})
+}
+
+func addYear(tx *sql.Tx, year uint64) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO year (year) VALUES (?);", year)
 	if err != nil {
 		return err
 	}
-	defer res.Close()
 
-	if !res.Next() {
-		_, err := d.d.Exec("INSERT INTO year (year) VALUES (?);", year)
+	return nil
+}
+
+// RemoveYear removes a year along with all of its months and days. If the
+// year still has documents ErrNotEmpty is returned unless cascade is set,
+// in which case the documents are moved to the trash.
+func (d *DB) RemoveYear(year uint64, cascade bool, deleted time.Time) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := removeDateDocs(tx, cascade, deleted, "year == ?", year)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
-}
-
-func (d *DB) RemoveYear(year uint64) error {
-	_, err := d.d.Exec("DELETE FROM year WHERE year == ?", year)
-	if err != nil {
-		return err
-	}
-	_, err = d.d.Exec("DELETE FROM month WHERE year == ?", year)
-	if err != nil {
-		return err
-	}
-	_, err = d.d.Exec("DELETE FROM day WHERE year == ?", year)
-	if err != nil {
-		return err
-	}
+		_, err = tx.Exec("DELETE FROM day WHERE year == ?", year)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM month WHERE year == ?", year)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM year WHERE year == ?", year)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return nil
+	})
 }
 
 // Months
@@ -75,7 +88,7 @@ func (d *DB) RemoveYear(year uint64) error {
 func (d *DB) GetMonths(year uint64) ([]uint64, error) {
 	res, err := d.d.Query("SELECT month FROM month WHERE year == ?", year)
 	if err != nil {
-		return nil, err
+		return nil, translateErr(err)
 	}
 	defer res.Close()
 
@@ -84,7 +97,7 @@ func (d *DB) GetMonths(year uint64) ([]uint64, error) {
 		var month uint64
 		err = res.Scan(&month)
 		if err != nil {
-			return nil, err
+			return nil, translateErr(err)
 		}
 		months = append(months, month)
 	}
@@ -95,7 +108,7 @@ func (d *DB) GetMonths(year uint64) ([]uint64, error) {
 func (d *DB) GetMonth(year uint64, month uint64) (uint64, error) {
 	res, err := d.d.Query("SELECT year, month FROM month WHERE year == ? AND month == ?", year, month)
 	if err != nil {
-		return 0, err
+		return 0, translateErr(err)
 	}
 	defer res.Close()
 
@@ -107,34 +120,45 @@ func (d *DB) GetMonth(year uint64, month uint64) (uint64, error) {
 }
 
 func (d *DB) AddMonth(year uint64, month uint64) error {
-	err := d.AddYear(year)
+	return d.withTx(func(tx *sql.Tx) error {
+		return addMonth(tx, year, month)
+	})
+}
+
+func addMonth(tx *sql.Tx, year uint64, month uint64) error {
+	err := addYear(tx, year)
 	if err != nil {
 		return err
 	}
 
-	res, err := d.d.Query("SELECT month, year FROM month WHERE year == ? AND month == ?", year, month)
+	_, err = tx.Exec("INSERT OR IGNORE INTO month (year, month) VALUES (?, ?);", year, month)
 	if err != nil {
 		return err
 	}
-	defer res.Close()
 
-	if !res.Next() {
-		_, err := d.d.Exec("INSERT INTO month (year, month) VALUES (?, ?);", year, month)
+	return nil
+}
+
+// RemoveMonth removes a month along with all of its days. Documents in the
+// month are handled the same way as in RemoveYear.
+func (d *DB) RemoveMonth(year uint64, month uint64, cascade bool, deleted time.Time) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := removeDateDocs(tx, cascade, deleted, "year == ? AND month == ?", year, month)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
-}
-
-func (d *DB) RemoveMonth(year uint64, month uint64) error {
-	_, err := d.d.Exec("DELETE FROM month WHERE year == ? AND month == ?", year, month)
-	if err != nil {
-		return err
-	}
+		_, err = tx.Exec("DELETE FROM day WHERE year == ? AND month == ?", year, month)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM month WHERE year == ? AND month == ?", year, month)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return nil
+	})
 }
 
 // Days
@@ -142,7 +166,7 @@ func (d *DB) RemoveMonth(year uint64, month uint64) error {
 func (d *DB) GetDays(year uint64, month uint64) ([]uint64, error) {
 	res, err := d.d.Query("SELECT day FROM day WHERE year == ? AND month == ?", year, month)
 	if err != nil {
-		return nil, err
+		return nil, translateErr(err)
 	}
 	defer res.Close()
 
@@ -151,7 +175,7 @@ func (d *DB) GetDays(year uint64, month uint64) ([]uint64, error) {
 		var day uint64
 		err = res.Scan(&day)
 		if err != nil {
-			return nil, err
+			return nil, translateErr(err)
 		}
 		days = append(days, day)
 	}
@@ -162,7 +186,7 @@ func (d *DB) GetDays(year uint64, month uint64) ([]uint64, error) {
 func (d *DB) GetDay(year uint64, month uint64, day uint64) (uint64, error) {
 	res, err := d.d.Query("SELECT year, month, day FROM day WHERE year == ? AND month == ? AND day == ?", year, month, day)
 	if err != nil {
-		return 0, err
+		return 0, translateErr(err)
 	}
 	defer res.Close()
 
@@ -174,29 +198,65 @@ func (d *DB) GetDay(year uint64, month uint64, day uint64) (uint64, error) {
 }
 
 func (d *DB) AddDay(year uint64, month uint64, day uint64) error {
-	err := d.AddMonth(year, month)
+	return d.withTx(func(tx *sql.Tx) error {
+		return addDay(tx, year, month, day)
+	})
+}
+
+func addDay(tx *sql.Tx, year uint64, month uint64, day uint64) error {
+	err := addMonth(tx, year, month)
 	if err != nil {
 		return err
 	}
 
-	res, err := d.d.Query("SELECT year, month, day FROM day WHERE year == ? AND month == ? AND day == ?", year, month, day)
+	_, err = tx.Exec("INSERT OR IGNORE INTO day (year, month, day) VALUES (?, ?, ?);", year, month, day)
 	if err != nil {
 		return err
 	}
-	defer res.Close()
 
-	if !res.Next() {
-		_, err := d.d.Exec("INSERT INTO day (year, month, day) VALUES (?, ?, ?);", year, month, day)
+	return nil
+}
+
+// RemoveDay removes a day. Documents filed on the day are handled the same
+// way as in RemoveYear.
+func (d *DB) RemoveDay(year uint64, month uint64, day uint64, cascade bool, deleted time.Time) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := removeDateDocs(tx, cascade, deleted, "year == ? AND month == ? AND day == ?", year, month, day)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		_, err = tx.Exec("DELETE FROM day WHERE year == ? AND month == ? AND day == ?", year, month, day)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
 }
 
-func (d *DB) RemoveDay(year uint64, month uint64, day uint64) error {
-	_, err := d.d.Exec("DELETE FROM day WHERE year == ? AND month == ? AND day == ?", year, month, day)
+// removeDateDocs moves the docs matching the date condition in where to the
+// trash, returning ErrNotEmpty if there are any and cascade isn't set.
+func removeDateDocs(tx *sql.Tx, cascade bool, deleted time.Time, where string, args ...interface{}) error {
+	var count int
+	err := tx.QueryRow(
+		"SELECT COUNT(*) FROM doc WHERE deleted IS NULL AND "+where,
+		args...,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return nil
+	} else if !cascade {
+		return ErrNotEmpty
+	}
+
+	_, err = tx.Exec(
+		"UPDATE doc SET deleted = ? WHERE deleted IS NULL AND "+where,
+		append([]interface{}{deleted.UTC()}, args...)...,
+	)
 	if err != nil {
 		return err
 	}
@@ -1,31 +1,34 @@
 package db
 
 import (
-	"os"
-
 	"database/sql"
+	"errors"
+	"time"
 
-	// Import the sqlite3 driver for package sql
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
 	d *sql.DB
 }
 
+// Open opens the database at dbPath, creating it if it doesn't exist and
+// migrating it to the latest schema version.
 func Open(dbPath string) (*DB, error) {
-	_, err := os.Stat(dbPath)
-	if os.IsNotExist(err) {
-		err = migrateDb(dbPath)
-		if err != nil {
-			return nil, err
-		}
-	} else if err != nil {
+	d, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=1")
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateDb(d)
+	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
-	d, err := sql.Open("sqlite3", dbPath)
+	err = migrateSearch(d)
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
@@ -37,3 +40,32 @@ func Open(dbPath string) (*DB, error) {
 func (d *DB) Close() error {
 	return d.d.Close()
 }
+
+// withTx runs fn in a transaction, committing it if fn succeeds and rolling
+// it back otherwise.
+func (d *DB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := d.d.Begin()
+	if err != nil {
+		return translateErr(err)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return translateErr(err)
+	}
+
+	return translateErr(tx.Commit())
+}
+
+// parseTime parses a time stored in a TEXT column by the sqlite driver.
+func parseTime(value string) (time.Time, error) {
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errors.New("Unknown time format")
+}
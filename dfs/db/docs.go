@@ -1 +1,264 @@
 package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Doc struct {
+	ID       uint64
+	Year     uint64
+	Month    uint64
+	Day      uint64
+	UUID     string
+	Filename string
+	Checksum string
+	Created  time.Time
+	// Deleted is when the doc was moved to the trash, or the zero time if
+	// it hasn't been.
+	Deleted time.Time
+}
+
+const docColumns = "doc_id, year, month, day, uuid, filename, checksum, created, deleted"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDoc(row rowScanner) (*Doc, error) {
+	doc := &Doc{}
+	var deleted *time.Time
+	err := row.Scan(
+		&doc.ID, &doc.Year, &doc.Month, &doc.Day,
+		&doc.UUID, &doc.Filename, &doc.Checksum, &doc.Created, &deleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted != nil {
+		doc.Deleted = *deleted
+	}
+
+	return doc, nil
+}
+
+func (d *DB) GetDoc(id uint64) (*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE doc_id == ?
+	`, id)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
+
+func (d *DB) GetDocByChecksum(checksum string) (*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE checksum == ? AND deleted IS NULL
+		ORDER BY doc_id
+		LIMIT 1
+	`, checksum)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
+
+// GetChecksumRefs returns the number of revisions whose contents have the
+// given checksum. A doc's current contents are always its latest revision so
+// this covers docs as well.
+func (d *DB) GetChecksumRefs(checksum string) (uint64, error) {
+	var refs uint64
+	err := d.d.QueryRow(
+		"SELECT COUNT(*) FROM revision WHERE checksum == ?",
+		checksum,
+	).Scan(&refs)
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	return refs, nil
+}
+
+// GetAllDocs returns every doc, including docs in the trash.
+func (d *DB) GetAllDocs() ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT ` + docColumns + `
+		FROM doc
+		ORDER BY doc_id
+	`)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (d *DB) GetDocs(year uint64, month uint64, day uint64) ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE year == ? AND month == ? AND day == ? AND deleted IS NULL
+		ORDER BY doc_id
+	`, year, month, day)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (d *DB) GetDocByName(year uint64, month uint64, day uint64, name string) (*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE year == ? AND month == ? AND day == ? AND filename == ?
+			AND deleted IS NULL
+		ORDER BY doc_id
+		LIMIT 1
+	`, year, month, day, name)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
+
+// PromoteScratch turns the scratch entry into a permanent doc entry using the
+// given uuid and checksum as its first revision, removing the scratch entry
+// in the same transaction.
+func (d *DB) PromoteScratch(scratchID uint64, uuid string, checksum string) (uint64, error) {
+	var docID int64
+	err := d.withTx(func(tx *sql.Tx) error {
+		var year, month, day uint64
+		err := tx.QueryRow(
+			"SELECT year, month, day FROM scratch WHERE scratch_id == ?",
+			scratchID,
+		).Scan(&year, &month, &day)
+		if err == sql.ErrNoRows {
+			return ErrNotExists
+		} else if err != nil {
+			return err
+		}
+
+		// The day may have been removed while the scratch file was
+		// being written so make sure it's still around.
+		err = addDay(tx, year, month, day)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`
+			INSERT INTO doc (year, month, day, uuid, filename, checksum, created)
+			SELECT year, month, day, ?, name, ?, created
+			FROM scratch
+			WHERE scratch_id == ?
+		`, uuid, checksum, scratchID)
+		if err != nil {
+			return err
+		}
+
+		docID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO revision (doc_id, rev, checksum, created)
+			SELECT ?, 1, checksum, created
+			FROM doc
+			WHERE doc_id == ?
+		`, docID, docID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM scratch WHERE scratch_id == ?", scratchID)
+		return err
+	})
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	return uint64(docID), nil
+}
+
+// MoveDoc files a doc under a new date and name, adding the date if it
+// doesn't exist. A doc already filed under the new date and name is moved to
+// the trash, the same as if it had been removed.
+func (d *DB) MoveDoc(docID uint64, year, month, day uint64, name string, now time.Time) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := addDay(tx, year, month, day)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE doc SET deleted = ?
+			WHERE year == ? AND month == ? AND day == ? AND filename == ?
+				AND doc_id != ? AND deleted IS NULL
+		`, now.UTC(), year, month, day, name, docID)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`
+			UPDATE doc SET year = ?, month = ?, day = ?, filename = ?
+			WHERE doc_id == ? AND deleted IS NULL
+		`, year, month, day, name, docID)
+		if err != nil {
+			return err
+		}
+
+		moved, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if moved == 0 {
+			return ErrNotExists
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2017, 4, 8, 10, 0, 0, 0, time.UTC)
+
+// addTestDoc files a doc the way a written scratch file is, with each
+// checksum after the first added as a newer revision.
+func addTestDoc(t *testing.T, d *DB, day uint64, name string, checksums ...string) uint64 {
+	t.Helper()
+
+	scratchID, err := d.CreateScratch(name, 2017, 4, int(day), testTime, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docID, err := d.PromoteScratch(scratchID, "uuid-"+name, checksums[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, checksum := range checksums[1:] {
+		_, err = d.AddRevision(docID, checksum, testTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return docID
+}
+
+func TestGetChecksumRefs(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// docs maps the name of each doc to the checksums of its
+		// revisions.
+		docs map[string][]string
+		// purge lists the docs moved to the trash and purged.
+		purge []string
+
+		wantPurged []string
+		want       map[string]uint64
+	}{
+		{
+			name: "shared contents",
+			docs: map[string][]string{
+				"a.pdf": {"one"},
+				"b.pdf": {"one"},
+				"c.pdf": {"two"},
+			},
+			want: map[string]uint64{"one": 2, "two": 1, "three": 0},
+		},
+		{
+			name: "old revisions",
+			docs: map[string][]string{
+				"a.pdf": {"one", "two", "one"},
+			},
+			want: map[string]uint64{"one": 2, "two": 1},
+		},
+		{
+			name: "purged doc",
+			docs: map[string][]string{
+				"a.pdf": {"one", "two"},
+				"b.pdf": {"two"},
+			},
+			purge:      []string{"a.pdf"},
+			wantPurged: []string{"one", "two"},
+			want:       map[string]uint64{"one": 0, "two": 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+
+			ids := make(map[string]uint64)
+			for name, checksums := range tc.docs {
+				ids[name] = addTestDoc(t, d, 8, name, checksums...)
+			}
+
+			purged := make([]string, 0)
+			for _, name := range tc.purge {
+				err := d.TrashDoc(ids[name], testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				checksums, err := d.PurgeDoc(ids[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				purged = append(purged, checksums...)
+			}
+			sort.Strings(purged)
+
+			if len(tc.purge) > 0 && !reflect.DeepEqual(purged, tc.wantPurged) {
+				t.Errorf("purged checksums = %v, want %v", purged, tc.wantPurged)
+			}
+
+			for checksum, want := range tc.want {
+				refs, err := d.GetChecksumRefs(checksum)
+				if err != nil {
+					t.Fatal(err)
+				} else if refs != want {
+					t.Errorf("GetChecksumRefs(%s) = %d, want %d", checksum, refs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveDoc(t *testing.T) {
+	tests := []struct {
+		name string
+
+		trash bool
+		day   uint64
+		to    string
+		err   error
+
+		wantDay  uint64
+		wantName string
+		// wantReplaced is whether the other doc filed on the day is
+		// replaced and moved to the trash.
+		wantReplaced bool
+	}{
+		{
+			name:     "rename",
+			day:      8,
+			to:       "c.pdf",
+			wantDay:  8,
+			wantName: "c.pdf",
+		},
+		{
+			name:     "new day",
+			day:      9,
+			to:       "a.pdf",
+			wantDay:  9,
+			wantName: "a.pdf",
+		},
+		{
+			name:         "replace",
+			day:          8,
+			to:           "b.pdf",
+			wantDay:      8,
+			wantName:     "b.pdf",
+			wantReplaced: true,
+		},
+		{
+			name:     "in trash",
+			trash:    true,
+			day:      8,
+			to:       "c.pdf",
+			err:      ErrNotExists,
+			wantDay:  8,
+			wantName: "a.pdf",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+			docID := addTestDoc(t, d, 8, "a.pdf", "one")
+			otherID := addTestDoc(t, d, 8, "b.pdf", "two")
+
+			if tc.trash {
+				err := d.TrashDoc(docID, testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := d.MoveDoc(docID, 2017, 4, tc.day, tc.to, testTime)
+			if err != tc.err {
+				t.Errorf("MoveDoc() = %v, want %v", err, tc.err)
+			}
+
+			doc, err := d.GetDoc(docID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Day != tc.wantDay || doc.Filename != tc.wantName {
+				t.Errorf("doc filed as %d/%s, want %d/%s",
+					doc.Day, doc.Filename, tc.wantDay, tc.wantName)
+			}
+
+			other, err := d.GetDoc(otherID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trashed := !other.Deleted.IsZero(); trashed != tc.wantReplaced {
+				t.Errorf("other doc trashed = %t, want %t", trashed, tc.wantReplaced)
+			}
+		})
+	}
+}
@@ -1,8 +1,52 @@
 package db
 
-import "errors"
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
 
 var (
-	ErrExists    = errors.New("Entry already exists")
-	ErrNotExists = errors.New("Entry does not exist")
+	ErrExists     = errors.New("Entry already exists")
+	ErrNotExists  = errors.New("Entry does not exist")
+	ErrNotEmpty   = errors.New("Entry is not empty")
+	ErrConstraint = errors.New("Entry violates a constraint")
+	ErrBusy       = errors.New("Database is busy")
+	ErrReadOnly   = errors.New("Database is read-only")
+
+	// ErrNotSupported is returned by searches when docfs was built
+	// without full text search.
+	ErrNotSupported = errors.New("Operation is not supported")
+
+	ErrSchemaTooNew = errors.New("Database schema is newer than supported")
 )
+
+// translateErr converts errors returned by the sqlite driver into the
+// errors above so callers don't need to know about sqlite. Errors without
+// an equivalent are returned as they are.
+func translateErr(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotExists
+	}
+
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return err
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrConstraint:
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return ErrExists
+		}
+		return ErrConstraint
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return ErrBusy
+	case sqlite3.ErrReadonly:
+		return ErrReadOnly
+	}
+
+	return err
+}
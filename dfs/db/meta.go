@@ -0,0 +1,80 @@
+package db
+
+import "database/sql"
+
+// DocMeta is a piece of free-form metadata attached to a doc.
+type DocMeta struct {
+	Key   string
+	Value []byte
+}
+
+func (d *DB) GetDocMeta(docID uint64) ([]*DocMeta, error) {
+	res, err := d.d.Query(`
+		SELECT key, value
+		FROM doc_meta
+		WHERE doc_id == ?
+		ORDER BY key
+	`, docID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	meta := make([]*DocMeta, 0)
+	for res.Next() {
+		m := &DocMeta{}
+		err = res.Scan(&m.Key, &m.Value)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		meta = append(meta, m)
+	}
+
+	return meta, nil
+}
+
+func (d *DB) GetDocMetaValue(docID uint64, key string) ([]byte, error) {
+	var value []byte
+	err := d.d.QueryRow(
+		"SELECT value FROM doc_meta WHERE doc_id == ? AND key == ?",
+		docID, key,
+	).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotExists
+	} else if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return value, nil
+}
+
+func (d *DB) SetDocMeta(docID uint64, key string, value []byte) error {
+	_, err := d.d.Exec(`
+		INSERT OR REPLACE INTO doc_meta (doc_id, key, value)
+		VALUES (?, ?, ?)
+	`, docID, key, value)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	return nil
+}
+
+func (d *DB) RemoveDocMeta(docID uint64, key string) error {
+	res, err := d.d.Exec(
+		"DELETE FROM doc_meta WHERE doc_id == ? AND key == ?",
+		docID, key,
+	)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return translateErr(err)
+	} else if removed == 0 {
+		return ErrNotExists
+	}
+
+	return nil
+}
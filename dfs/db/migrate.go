@@ -4,15 +4,108 @@ import (
 	"database/sql"
 )
 
-func migrateDb(dbPath string) error {
-	db, err := sql.Open("sqlite3", dbPath)
+type migration func(tx *sql.Tx) error
+
+// migrations holds every schema change in the order it was made. The schema
+// version of a database is the number of migrations applied to it, so new
+// migrations must only ever be appended to the end of the list.
+//
+// Databases created before schema versioning was added have no version
+// recorded, so the first migrations only create tables that don't exist yet.
+var migrations = []migration{
+	migrateBase,
+	migrateDocs,
+	migrateDocTags,
+	migrateDateOrphans,
+	migrateDocChecksumIndex,
+	migrateScratchState,
+	migrateRevisions,
+	migrateTrash,
+	migrateDocMeta,
+	migrateTagParents,
+	migrateDocIndexed,
+	migrateLiveTagNames,
+}
+
+func migrateDb(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER
+		);
+	`)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
 
-	_, err = db.Exec(`
-		CREATE TABLE tag (
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for idx := version; idx < len(migrations); idx++ {
+		err = runMigration(db, idx+1, migrations[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getSchemaVersion(db *sql.DB) (int, error) {
+	res, err := db.Query("SELECT version FROM schema_version")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return 0, nil
+	}
+
+	var version int
+	err = res.Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func runMigration(db *sql.DB, version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = m(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM schema_version")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrateBase(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS tag (
 			tag_id INTEGER PRIMARY KEY,
 			name TEXT,
 			UNIQUE(name)
@@ -22,8 +115,8 @@ func migrateDb(dbPath string) error {
 		return err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE year (
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS year (
 			year INTEGER,
 			PRIMARY KEY(year)
 		);
@@ -32,8 +125,8 @@ func migrateDb(dbPath string) error {
 		return err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE month (
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS month (
 			year INTEGER,
 			month INTEGER,
 			PRIMARY KEY(year, month),
@@ -44,8 +137,8 @@ func migrateDb(dbPath string) error {
 		return err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE day (
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS day (
 			year INTEGER,
 			month INTEGER,
 			day INTEGER,
@@ -57,8 +150,8 @@ func migrateDb(dbPath string) error {
 		return err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE  scratch (
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS scratch (
 			scratch_id INTEGER,
 			name TEXT,
 			year INTEGER,
@@ -72,22 +165,286 @@ func migrateDb(dbPath string) error {
 		return err
 	}
 
-	// Docs
-	/*
-		id
-		year
-		month
-		day
-		uuid
-		filename
-		checksum
-	*/
+	return nil
+}
+
+func migrateDocs(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS doc (
+			doc_id INTEGER,
+			year INTEGER,
+			month INTEGER,
+			day INTEGER,
+			uuid TEXT,
+			filename TEXT,
+			checksum TEXT,
+			created TIMESTAMP,
+			PRIMARY KEY(doc_id),
+			UNIQUE(uuid)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func migrateDocTags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS doc_tag (
+			tag_id INTEGER,
+			doc_id INTEGER,
+			PRIMARY KEY(tag_id, doc_id),
+			FOREIGN KEY(tag_id) REFERENCES tag(tag_id),
+			FOREIGN KEY(doc_id) REFERENCES doc(doc_id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateDateOrphans removes months and days left behind by removing their
+// year or month before foreign keys were enforced. Foreign keys are only
+// checked once the migration commits since the orphaned months can still
+// have days of their own.
+func migrateDateOrphans(tx *sql.Tx) error {
+	_, err := tx.Exec("PRAGMA defer_foreign_keys = ON")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM month
+		WHERE year NOT IN (SELECT year FROM year)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM day
+		WHERE NOT EXISTS (
+			SELECT 1 FROM month
+			WHERE month.year == day.year AND month.month == day.month
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func migrateDocChecksumIndex(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE INDEX IF NOT EXISTS doc_checksum ON doc(checksum);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateScratchState tracks the state and tag of scratch entries so they
+// can be recovered on startup. Existing scratch entries can't have been
+// finished so they're left as open.
+func migrateScratchState(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE scratch ADD COLUMN state TEXT NOT NULL DEFAULT 'open';
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE scratch ADD COLUMN tag_id INTEGER REFERENCES tag(tag_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateRevisions keeps every version of a document's contents. The
+// contents documents already have become their first revision.
+func migrateRevisions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS revision (
+			revision_id INTEGER,
+			doc_id INTEGER,
+			rev INTEGER,
+			checksum TEXT,
+			created TIMESTAMP,
+			PRIMARY KEY(revision_id),
+			UNIQUE(doc_id, rev),
+			FOREIGN KEY(doc_id) REFERENCES doc(doc_id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS revision_checksum ON revision(checksum);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO revision (doc_id, rev, checksum, created)
+		SELECT doc_id, 1, checksum, created
+		FROM doc
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE scratch ADD COLUMN doc_id INTEGER REFERENCES doc(doc_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateTrash lets docs and tags be moved to the trash instead of being
+// removed straight away.
+func migrateTrash(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE doc ADD COLUMN deleted TIMESTAMP;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE tag ADD COLUMN deleted TIMESTAMP;
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func migrateDocMeta(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS doc_meta (
+			doc_id INTEGER,
+			key TEXT,
+			value BLOB,
+			PRIMARY KEY(doc_id, key),
+			FOREIGN KEY(doc_id) REFERENCES doc(doc_id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateTagParents lets tags nest under other tags. Tag names only need to
+// be unique among their siblings now, so the table is rebuilt without the
+// old unique constraint. Renaming a table also renames the references to it,
+// so the tags are copied aside and put back once the new table is created.
+// Foreign keys are only checked once the migration commits since doc_tag and
+// scratch refer to the table being rebuilt.
+func migrateTagParents(tx *sql.Tx) error {
+	_, err := tx.Exec("PRAGMA defer_foreign_keys = ON")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE tag_copy AS SELECT tag_id, name, deleted FROM tag;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DROP TABLE tag")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE tag (
+			tag_id INTEGER PRIMARY KEY,
+			parent_id INTEGER,
+			name TEXT,
+			deleted TIMESTAMP,
+			FOREIGN KEY(parent_id) REFERENCES tag(tag_id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Top level tags have no parent, and NULLs are never equal to each
+	// other in a unique index, so they're indexed as having parent 0.
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX tag_parent_name ON tag(IFNULL(parent_id, 0), name);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO tag (tag_id, name, deleted)
+		SELECT tag_id, name, deleted FROM tag_copy;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DROP TABLE tag_copy")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateDocIndexed records the checksum of the contents each doc was last
+// extracted from, so docs still waiting to be extracted are found again
+// when docfs is next started.
+func migrateDocIndexed(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE doc ADD COLUMN indexed_checksum TEXT;
+	`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
-	// Doc Tags
-	/*
-		tag_id
-		doc_id
-	*/
+// migrateLiveTagNames only keeps the names of live tags unique among their
+// siblings, so a tag in the trash doesn't stop another tag from taking its
+// name.
+func migrateLiveTagNames(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP INDEX tag_parent_name")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX tag_parent_name ON tag(IFNULL(parent_id, 0), name)
+		WHERE deleted IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
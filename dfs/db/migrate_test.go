@@ -0,0 +1,290 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// openTestDB opens an empty in-memory database. Every connection to an
+// in-memory database gets its own database, so only one is ever opened.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	d, err := sql.Open("sqlite3", "file::memory:?_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetMaxOpenConns(1)
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+// execAll runs each statement, failing the test on the first error.
+func execAll(t *testing.T, d *sql.DB, stmts ...string) {
+	t.Helper()
+
+	for _, stmt := range stmts {
+		_, err := d.Exec(stmt)
+		if err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+}
+
+// migrateTo migrates a database to the schema version with the first
+// version migrations applied.
+func migrateTo(t *testing.T, d *sql.DB, version int) {
+	t.Helper()
+
+	all := migrations
+	defer func() { migrations = all }()
+
+	migrations = all[:version]
+	err := migrateDb(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queryInts returns the single integer column of every row a query
+// returns.
+func queryInts(t *testing.T, d *sql.DB, query string) []int64 {
+	t.Helper()
+
+	res, err := d.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	defer res.Close()
+
+	values := make([]int64, 0)
+	for res.Next() {
+		var value int64
+		err = res.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+
+	err = res.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return values
+}
+
+func equalInts(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMigrateDb(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, d *sql.DB)
+		check func(t *testing.T, d *sql.DB)
+	}{
+		{
+			name:  "empty",
+			setup: func(t *testing.T, d *sql.DB) {},
+			check: func(t *testing.T, d *sql.DB) {},
+		},
+		{
+			// The tables created before schema versioning was added, with
+			// no schema_version and no foreign keys enforced.
+			name: "baseline",
+			setup: func(t *testing.T, d *sql.DB) {
+				execAll(t, d,
+					"PRAGMA foreign_keys = OFF",
+					`CREATE TABLE tag (
+						tag_id INTEGER PRIMARY KEY,
+						name TEXT,
+						UNIQUE(name)
+					)`,
+					`CREATE TABLE year (
+						year INTEGER,
+						PRIMARY KEY(year)
+					)`,
+					`CREATE TABLE month (
+						year INTEGER,
+						month INTEGER,
+						PRIMARY KEY(year, month),
+						FOREIGN KEY(year) REFERENCES year(year)
+					)`,
+					`CREATE TABLE day (
+						year INTEGER,
+						month INTEGER,
+						day INTEGER,
+						PRIMARY KEY(year, month, day),
+						FOREIGN KEY(year, month) REFERENCES month(year, month)
+					)`,
+					`CREATE TABLE  scratch (
+						scratch_id INTEGER,
+						name TEXT,
+						year INTEGER,
+						month INTEGER,
+						day INTEGER,
+						created TEXT,
+						PRIMARY KEY(scratch_id)
+					)`,
+					"INSERT INTO tag (tag_id, name) VALUES (1, 'taxes'), (2, 'home')",
+					"INSERT INTO year VALUES (2017)",
+					"INSERT INTO month VALUES (2017, 4), (2016, 1)",
+					"INSERT INTO day VALUES (2017, 4, 8), (2017, 5, 1), (2016, 1, 1)",
+					"PRAGMA foreign_keys = ON",
+				)
+			},
+			check: func(t *testing.T, d *sql.DB) {
+				months := queryInts(t, d, "SELECT year * 100 + month FROM month ORDER BY 1")
+				if !equalInts(months, []int64{201704}) {
+					t.Errorf("months = %v, want orphaned months removed", months)
+				}
+
+				days := queryInts(t, d, "SELECT year * 10000 + month * 100 + day FROM day ORDER BY 1")
+				if !equalInts(days, []int64{20170408}) {
+					t.Errorf("days = %v, want orphaned days removed", days)
+				}
+
+				tags := queryInts(t, d, "SELECT tag_id FROM tag WHERE parent_id IS NULL ORDER BY tag_id")
+				if !equalInts(tags, []int64{1, 2}) {
+					t.Errorf("top level tags = %v, want [1 2]", tags)
+				}
+			},
+		},
+		{
+			// Docs written before revisions were kept get their contents as
+			// their first revision.
+			name: "before revisions",
+			setup: func(t *testing.T, d *sql.DB) {
+				migrateTo(t, d, 6)
+				execAll(t, d,
+					"INSERT INTO year VALUES (2017)",
+					"INSERT INTO month VALUES (2017, 4)",
+					"INSERT INTO day VALUES (2017, 4, 8)",
+					`INSERT INTO doc (doc_id, year, month, day, uuid, filename, checksum, created)
+					VALUES
+						(1, 2017, 4, 8, 'a', 'a.pdf', 'aaaa', '2017-04-08 10:00:00'),
+						(2, 2017, 4, 8, 'b', 'b.pdf', 'bbbb', '2017-04-08 11:00:00')`,
+				)
+			},
+			check: func(t *testing.T, d *sql.DB) {
+				revs := queryInts(t, d, `
+					SELECT doc_id FROM revision
+					WHERE rev == 1 AND checksum == (
+						SELECT checksum FROM doc WHERE doc.doc_id == revision.doc_id
+					)
+					ORDER BY doc_id
+				`)
+				if !equalInts(revs, []int64{1, 2}) {
+					t.Errorf("docs with a first revision = %v, want [1 2]", revs)
+				}
+
+				unindexed := queryInts(t, d, "SELECT doc_id FROM doc WHERE indexed_checksum IS NULL ORDER BY doc_id")
+				if !equalInts(unindexed, []int64{1, 2}) {
+					t.Errorf("unindexed docs = %v, want [1 2]", unindexed)
+				}
+			},
+		},
+		{
+			// Tags from before tags could nest are rebuilt at the top
+			// level, keeping their IDs, docs, trash and scratch entries.
+			name: "before tag parents",
+			setup: func(t *testing.T, d *sql.DB) {
+				migrateTo(t, d, 9)
+				execAll(t, d,
+					"INSERT INTO year VALUES (2017)",
+					"INSERT INTO month VALUES (2017, 4)",
+					"INSERT INTO day VALUES (2017, 4, 8)",
+					`INSERT INTO doc (doc_id, year, month, day, uuid, filename, checksum, created)
+					VALUES (1, 2017, 4, 8, 'a', 'a.pdf', 'aaaa', '2017-04-08 10:00:00')`,
+					`INSERT INTO tag (tag_id, name, deleted)
+					VALUES (3, 'taxes', NULL), (5, 'home', '2017-04-09 10:00:00')`,
+					"INSERT INTO doc_tag (tag_id, doc_id) VALUES (3, 1), (5, 1)",
+					`INSERT INTO scratch (scratch_id, name, year, month, day, created, tag_id)
+					VALUES (1, 'b.pdf', 2017, 4, 8, '2017-04-08 12:00:00', 3)`,
+				)
+			},
+			check: func(t *testing.T, d *sql.DB) {
+				tags := queryInts(t, d, "SELECT tag_id FROM tag WHERE parent_id IS NULL ORDER BY tag_id")
+				if !equalInts(tags, []int64{3, 5}) {
+					t.Errorf("top level tags = %v, want [3 5]", tags)
+				}
+
+				trashed := queryInts(t, d, "SELECT tag_id FROM tag WHERE deleted IS NOT NULL")
+				if !equalInts(trashed, []int64{5}) {
+					t.Errorf("trashed tags = %v, want [5]", trashed)
+				}
+
+				docTags := queryInts(t, d, "SELECT tag_id FROM doc_tag WHERE doc_id == 1 ORDER BY tag_id")
+				if !equalInts(docTags, []int64{3, 5}) {
+					t.Errorf("doc tags = %v, want [3 5]", docTags)
+				}
+
+				// Tag names are only unique among their live siblings now.
+				execAll(t, d,
+					"INSERT INTO tag (parent_id, name) VALUES (3, 'home')",
+					"INSERT INTO tag (name) VALUES ('home')",
+				)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestDB(t)
+			tc.setup(t, d)
+
+			err := migrateDb(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			version, err := getSchemaVersion(d)
+			if err != nil {
+				t.Fatal(err)
+			} else if version != len(migrations) {
+				t.Errorf("schema version = %d, want %d", version, len(migrations))
+			}
+
+			res, err := d.Query("PRAGMA foreign_key_check")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Next() {
+				t.Error("foreign key check found violations")
+			}
+			res.Close()
+
+			tc.check(t, d)
+
+			// Migrating an up to date database does nothing.
+			err = migrateDb(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMigrateDbTooNew(t *testing.T) {
+	d := openTestDB(t)
+	execAll(t, d,
+		"CREATE TABLE schema_version (version INTEGER)",
+		"INSERT INTO schema_version (version) VALUES (1000)",
+	)
+
+	err := migrateDb(d)
+	if err != ErrSchemaTooNew {
+		t.Errorf("migrateDb() = %v, want ErrSchemaTooNew", err)
+	}
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Revision is one version of a document's contents. Revisions are numbered
+// from 1 for each document and the latest revision is always the document's
+// current contents.
+type Revision struct {
+	ID       uint64
+	DocID    uint64
+	Rev      uint64
+	Checksum string
+	Created  time.Time
+}
+
+const revisionColumns = "revision_id, doc_id, rev, checksum, created"
+
+func scanRevision(row rowScanner) (*Revision, error) {
+	r := &Revision{}
+	err := row.Scan(&r.ID, &r.DocID, &r.Rev, &r.Checksum, &r.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (d *DB) GetRevisions(docID uint64) ([]*Revision, error) {
+	res, err := d.d.Query(`
+		SELECT `+revisionColumns+`
+		FROM revision
+		WHERE doc_id == ?
+		ORDER BY rev
+	`, docID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	revs := make([]*Revision, 0)
+	for res.Next() {
+		r, err := scanRevision(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		revs = append(revs, r)
+	}
+
+	return revs, nil
+}
+
+func (d *DB) GetRevision(docID uint64, rev uint64) (*Revision, error) {
+	res, err := d.d.Query(`
+		SELECT `+revisionColumns+`
+		FROM revision
+		WHERE doc_id == ? AND rev == ?
+	`, docID, rev)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	r, err := scanRevision(res)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return r, nil
+}
+
+// GetLatestRevision returns a doc's latest revision, which holds the doc's
+// current contents.
+func (d *DB) GetLatestRevision(docID uint64) (*Revision, error) {
+	res, err := d.d.Query(`
+		SELECT `+revisionColumns+`
+		FROM revision
+		WHERE doc_id == ?
+		ORDER BY rev DESC
+		LIMIT 1
+	`, docID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	r, err := scanRevision(res)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return r, nil
+}
+
+// AddRevision adds a new revision with the given contents to a document and
+// makes it the document's current contents.
+func (d *DB) AddRevision(docID uint64, checksum string, created time.Time) (uint64, error) {
+	var rev uint64
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		rev, err = addRevision(tx, docID, checksum, created)
+		return err
+	})
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	return rev, nil
+}
+
+func addRevision(tx *sql.Tx, docID uint64, checksum string, created time.Time) (uint64, error) {
+	var rev uint64
+	err := tx.QueryRow(
+		"SELECT COALESCE(MAX(rev), 0) + 1 FROM revision WHERE doc_id == ?",
+		docID,
+	).Scan(&rev)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO revision (doc_id, rev, checksum, created)
+		VALUES (?, ?, ?, ?)
+	`, docID, rev, checksum, created)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		"UPDATE doc SET checksum = ? WHERE doc_id == ?",
+		checksum, docID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	} else if updated == 0 {
+		return 0, ErrNotExists
+	}
+
+	return rev, nil
+}
+
+// PromoteRevisionScratch adds the contents of a scratch entry created with
+// CreateDocScratch as a new revision of its document, removing the scratch
+// entry in the same transaction.
+func (d *DB) PromoteRevisionScratch(scratchID uint64, checksum string) (uint64, error) {
+	var rev uint64
+	err := d.withTx(func(tx *sql.Tx) error {
+		var docID sql.NullInt64
+		var created string
+		err := tx.QueryRow(
+			"SELECT doc_id, created FROM scratch WHERE scratch_id == ?",
+			scratchID,
+		).Scan(&docID, &created)
+		if err == sql.ErrNoRows || (err == nil && !docID.Valid) {
+			return ErrNotExists
+		} else if err != nil {
+			return err
+		}
+
+		createdTime, err := parseTime(created)
+		if err != nil {
+			return err
+		}
+
+		rev, err = addRevision(tx, uint64(docID.Int64), checksum, createdTime)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM scratch WHERE scratch_id == ?", scratchID)
+		return err
+	})
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	return rev, nil
+}
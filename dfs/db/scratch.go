@@ -1,17 +1,174 @@
 package db
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
+
+// Scratch states track how far a scratch file got so it can be recovered
+// if docfs stops before the scratch file is promoted.
+const (
+	// ScratchOpen scratch files are still being written.
+	ScratchOpen = "open"
+	// ScratchClosed scratch files have been completely written and are
+	// waiting to be promoted.
+	ScratchClosed = "closed"
+	// ScratchLost scratch files were still being written when docfs
+	// stopped and have been moved to lost+found.
+	ScratchLost = "lost"
+)
+
+type Scratch struct {
+	ID      uint64
+	Name    string
+	Year    uint64
+	Month   uint64
+	Day     uint64
+	Created time.Time
+	State   string
+	TagID   uint64
+	// DocID is the document the scratch entry is a new revision of, or 0
+	// if it's a new document.
+	DocID uint64
+}
+
+const scratchColumns = "scratch_id, name, year, month, day, created, state, tag_id, doc_id"
+
+func scanScratch(row rowScanner) (*Scratch, error) {
+	s := &Scratch{}
+	var created string
+	var tagID, docID sql.NullInt64
+	err := row.Scan(
+		&s.ID, &s.Name, &s.Year, &s.Month, &s.Day,
+		&created, &s.State, &tagID, &docID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Created, err = parseTime(created)
+	if err != nil {
+		return nil, err
+	}
+	s.TagID = uint64(tagID.Int64)
+	s.DocID = uint64(docID.Int64)
+
+	return s, nil
+}
+
+// CreateScratch adds an open scratch entry. If tagID isn't 0 the tag is
+// applied to the document once it's promoted.
+func (d *DB) CreateScratch(name string, year, month, day int, created time.Time, tagID uint64) (uint64, error) {
+	var nullTagID sql.NullInt64
+	if tagID != 0 {
+		nullTagID.Int64 = int64(tagID)
+		nullTagID.Valid = true
+	}
 
-func (d *DB) CreateScratch(name string, year, month, day int, created time.Time) (uint64, error) {
 	res, err := d.d.Exec(`
-			INSERT INTO scratch (name, created, year, month, day)
-			VALUES (?, ?, ?, ?, ?);
+			INSERT INTO scratch (name, created, year, month, day, state, tag_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?);
 		`,
-		name, created, year, month, day)
+		name, created, year, month, day, ScratchOpen, nullTagID)
 	if err != nil {
-		return 0, err
+		return 0, translateErr(err)
 	}
 
 	id, err := res.LastInsertId()
-	return uint64(id), err
+	return uint64(id), translateErr(err)
+}
+
+// CreateDocScratch adds an open scratch entry for a new revision of an
+// existing document, using the document's name and date.
+func (d *DB) CreateDocScratch(docID uint64, created time.Time) (uint64, error) {
+	res, err := d.d.Exec(`
+			INSERT INTO scratch (name, created, year, month, day, state, doc_id)
+			SELECT filename, ?, year, month, day, ?, doc_id
+			FROM doc
+			WHERE doc_id == ?
+		`,
+		created, ScratchOpen, docID)
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, translateErr(err)
+	} else if inserted == 0 {
+		return 0, ErrNotExists
+	}
+
+	id, err := res.LastInsertId()
+	return uint64(id), translateErr(err)
+}
+
+func (d *DB) GetScratch(id uint64) (*Scratch, error) {
+	res, err := d.d.Query(`
+		SELECT `+scratchColumns+`
+		FROM scratch
+		WHERE scratch_id == ?
+	`, id)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	s, err := scanScratch(res)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return s, nil
+}
+
+// GetScratches returns all scratch entries in the given state, or every
+// scratch entry if state is empty.
+func (d *DB) GetScratches(state string) ([]*Scratch, error) {
+	res, err := d.d.Query(`
+		SELECT `+scratchColumns+`
+		FROM scratch
+		WHERE ? == '' OR state == ?
+		ORDER BY scratch_id
+	`, state, state)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	scratches := make([]*Scratch, 0)
+	for res.Next() {
+		s, err := scanScratch(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		scratches = append(scratches, s)
+	}
+
+	return scratches, nil
+}
+
+func (d *DB) SetScratchState(id uint64, state string) error {
+	_, err := d.d.Exec(
+		"UPDATE scratch SET state = ? WHERE scratch_id == ?",
+		state, id,
+	)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	return nil
+}
+
+func (d *DB) RemoveScratch(id uint64) error {
+	_, err := d.d.Exec("DELETE FROM scratch WHERE scratch_id == ?", id)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	return nil
 }
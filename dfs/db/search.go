@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// Full text search is only available when docfs is built with the
+// sqlite_fts5 build tag, which builds SQLite with the FTS5 extension. The
+// search index isn't part of the versioned schema since it depends on how
+// docfs was built, so it's created separately when the database is opened.
+
+// IndexDoc replaces the text a doc is found by in searches with the text
+// extracted from the contents with the given checksum. An empty text
+// removes the doc from the index.
+func (d *DB) IndexDoc(docID uint64, checksum string, text string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := indexDoc(tx, docID, text)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE doc SET indexed_checksum = ? WHERE doc_id == ?",
+			checksum, docID,
+		)
+		return err
+	})
+}
+
+// GetUnindexedDocs returns the live docs whose current contents haven't
+// been indexed yet.
+func (d *DB) GetUnindexedDocs() ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT ` + docColumns + `
+		FROM doc
+		WHERE deleted IS NULL
+			AND (indexed_checksum IS NULL OR indexed_checksum != checksum)
+		ORDER BY doc_id
+	`)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
@@ -0,0 +1,141 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package db
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// migrateSearch creates the search index. The rowid of each row in the
+// index is the ID of the doc the text belongs to. Docs extracted while docfs
+// was built without search were never added to the index, so every doc is
+// extracted again when the index is first created.
+func migrateSearch(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT COUNT(*) > 0 FROM sqlite_master
+		WHERE type == 'table' AND name == 'doc_text'
+	`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = db.Exec(`
+		CREATE VIRTUAL TABLE doc_text USING fts5(body);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE doc SET indexed_checksum = NULL")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func indexDoc(tx *sql.Tx, docID uint64, text string) error {
+	_, err := tx.Exec("DELETE FROM doc_text WHERE rowid == ?", docID)
+	if err != nil {
+		return err
+	}
+
+	if text == "" {
+		return nil
+	}
+
+	_, err = tx.Exec("INSERT INTO doc_text (rowid, body) VALUES (?, ?)", docID, text)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func unindexDocs(tx *sql.Tx, where string, args ...interface{}) error {
+	_, err := tx.Exec(`
+		DELETE FROM doc_text
+		WHERE rowid IN (SELECT doc_id FROM doc WHERE `+where+`)
+	`, args...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// translateSearchErr reports queries FTS5 can't make sense of, such as ones
+// with unbalanced quotes or unknown column filters, as ErrConstraint. The
+// rest of the statement is fixed so any generic error comes from the query.
+func translateSearchErr(err error) error {
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrError {
+		return ErrConstraint
+	}
+
+	return translateErr(err)
+}
+
+// SearchDocs returns the live docs matching an FTS5 query, best match first.
+func (d *DB) SearchDocs(query string) ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		INNER JOIN doc_text ON doc_text.rowid == doc.doc_id
+		WHERE doc_text MATCH ? AND doc.deleted IS NULL
+		ORDER BY bm25(doc_text), doc.doc_id
+	`, query)
+	if err != nil {
+		return nil, translateSearchErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateSearchErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	err = res.Err()
+	if err != nil {
+		return nil, translateSearchErr(err)
+	}
+
+	return docs, nil
+}
+
+// SearchDocByName returns the best matching live doc for an FTS5 query with
+// the given name.
+func (d *DB) SearchDocByName(query string, name string) (*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		INNER JOIN doc_text ON doc_text.rowid == doc.doc_id
+		WHERE doc_text MATCH ? AND doc.filename == ? AND doc.deleted IS NULL
+		ORDER BY bm25(doc_text), doc.doc_id
+		LIMIT 1
+	`, query, name)
+	if err != nil {
+		return nil, translateSearchErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		err = res.Err()
+		if err != nil {
+			return nil, translateSearchErr(err)
+		}
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
@@ -0,0 +1,32 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package db
+
+import (
+	"database/sql"
+)
+
+func migrateSearch(db *sql.DB) error {
+	return nil
+}
+
+func indexDoc(tx *sql.Tx, docID uint64, text string) error {
+	return nil
+}
+
+func unindexDocs(tx *sql.Tx, where string, args ...interface{}) error {
+	return nil
+}
+
+// SearchDocs always returns ErrNotSupported since docfs was built without
+// full text search.
+func (d *DB) SearchDocs(query string) ([]*Doc, error) {
+	return nil, ErrNotSupported
+}
+
+// SearchDocByName always returns ErrNotSupported since docfs was built
+// without full text search.
+func (d *DB) SearchDocByName(query string, name string) (*Doc, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetUnindexedDocs(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// index maps the name of each doc to index to the checksum its
+		// text is indexed from.
+		index map[string]string
+		// failed lists the docs nothing could be extracted from, which are
+		// indexed with no text so they aren't extracted again.
+		failed []string
+		// revise lists the docs given a new revision after indexing.
+		revise []string
+		// trash lists the docs moved to the trash.
+		trash []string
+
+		want []string
+	}{
+		{
+			name: "new docs",
+			want: []string{"a.pdf", "b.pdf"},
+		},
+		{
+			name:  "indexed",
+			index: map[string]string{"a.pdf": "one"},
+			want:  []string{"b.pdf"},
+		},
+		{
+			name:   "failed extraction",
+			index:  map[string]string{"a.pdf": "one"},
+			failed: []string{"b.pdf"},
+			want:   []string{},
+		},
+		{
+			name:   "new revision",
+			index:  map[string]string{"a.pdf": "one", "b.pdf": "two"},
+			revise: []string{"a.pdf"},
+			want:   []string{"a.pdf"},
+		},
+		{
+			name:  "old revision",
+			index: map[string]string{"b.pdf": "zero"},
+			want:  []string{"a.pdf", "b.pdf"},
+		},
+		{
+			name:  "trashed",
+			trash: []string{"b.pdf"},
+			want:  []string{"a.pdf"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+			ids := map[string]uint64{
+				"a.pdf": addTestDoc(t, d, 8, "a.pdf", "one"),
+				"b.pdf": addTestDoc(t, d, 8, "b.pdf", "zero", "two"),
+			}
+			names := make(map[uint64]string)
+			for name, id := range ids {
+				names[id] = name
+			}
+
+			for name, checksum := range tc.index {
+				err := d.IndexDoc(ids[name], checksum, "text of "+name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range tc.failed {
+				doc, err := d.GetDoc(ids[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = d.IndexDoc(doc.ID, doc.Checksum, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range tc.revise {
+				_, err := d.AddRevision(ids[name], "three", testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range tc.trash {
+				err := d.TrashDoc(ids[name], testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			docs, err := d.GetUnindexedDocs()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unindexed := make([]string, 0)
+			for _, doc := range docs {
+				unindexed = append(unindexed, names[doc.ID])
+			}
+			if !reflect.DeepEqual(unindexed, tc.want) {
+				t.Errorf("unindexed docs = %v, want %v", unindexed, tc.want)
+			}
+		})
+	}
+}
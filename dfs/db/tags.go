@@ -1,91 +1,685 @@
 package db
 
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
 type Tag struct {
-	ID   uint64
-	Name string
+	ID       uint64
+	ParentID uint64
+	Name     string
+
+	// Path is the tag's name prefixed with the names of its ancestors,
+	// separated by TagPathSeparator. It's only filled in by GetTags and
+	// GetDocTags.
+	Path string
 }
 
-func (d *DB) GetTags() ([]*Tag, error) {
-	tags := make([]*Tag, 0)
+// TagPathSeparator separates the names of nested tags in a tag path, as in
+// finance/taxes/2017.
+const TagPathSeparator = "/"
 
-	res, err := d.d.Query("SELECT tag_id, name FROM tag")
-	if err != nil {
-		return nil, err
+// liveTagTree is a common table expression for every live tag along with its
+// path. Tags under a tag in the trash aren't live since they can't be reached
+// until their ancestor is restored.
+const liveTagTree = `
+	WITH RECURSIVE tag_tree(tag_id, parent_id, name, path) AS (
+		SELECT tag_id, parent_id, name, name FROM tag
+		WHERE parent_id IS NULL AND deleted IS NULL
+		UNION ALL
+		SELECT tag.tag_id, tag.parent_id, tag.name,
+			tag_tree.path || '` + TagPathSeparator + `' || tag.name
+		FROM tag
+		INNER JOIN tag_tree ON tag.parent_id == tag_tree.tag_id
+		WHERE tag.deleted IS NULL
+	)`
+
+// nullTagID stores a tag ID of 0 as NULL.
+func nullTagID(tagID uint64) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: int64(tagID),
+		Valid: tagID != 0,
 	}
-	defer res.Close()
+}
 
+func scanTags(res *sql.Rows, withPath bool) ([]*Tag, error) {
+	tags := make([]*Tag, 0)
 	for res.Next() {
-		var tagID uint64
-		var tagName string
-		err = res.Scan(&tagID, &tagName)
+		tag := &Tag{}
+		var parentID sql.NullInt64
+
+		var err error
+		if withPath {
+			err = res.Scan(&tag.ID, &parentID, &tag.Name, &tag.Path)
+		} else {
+			err = res.Scan(&tag.ID, &parentID, &tag.Name)
+		}
 		if err != nil {
 			return nil, err
 		}
-		tags = append(tags, &Tag{
-			ID:   tagID,
-			Name: tagName,
-		})
+		tag.ParentID = uint64(parentID.Int64)
+
+		tags = append(tags, tag)
 	}
 
 	return tags, nil
 }
 
-func (d *DB) GetTag(tag string) (*Tag, error) {
-	res, err := d.d.Query("SELECT tag_id, name FROM tag WHERE name == ?", tag)
+// GetTags returns every live tag, nested or not, ordered by path.
+func (d *DB) GetTags() ([]*Tag, error) {
+	res, err := d.d.Query(liveTagTree + `
+		SELECT tag_id, parent_id, name, path FROM tag_tree
+		ORDER BY path
+	`)
 	if err != nil {
-		return nil, err
+		return nil, translateErr(err)
 	}
 	defer res.Close()
 
-	if !res.Next() {
-		return nil, nil
+	tags, err := scanTags(res, true)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return tags, nil
+}
+
+// GetChildTags returns the tags directly under a tag, or the top level tags
+// if parentID is 0.
+func (d *DB) GetChildTags(parentID uint64) ([]*Tag, error) {
+	res, err := d.d.Query(`
+		SELECT tag_id, parent_id, name FROM tag
+		WHERE IFNULL(parent_id, 0) == ? AND deleted IS NULL
+		ORDER BY name
+	`, parentID)
+	if err != nil {
+		return nil, translateErr(err)
 	}
+	defer res.Close()
 
+	tags, err := scanTags(res, false)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return tags, nil
+}
+
+// GetTag returns the tag with the given name directly under a tag, or at
+// the top level if parentID is 0.
+func (d *DB) GetTag(parentID uint64, tag string) (*Tag, error) {
+	res, err := d.d.Query(`
+		SELECT tag_id, parent_id, name FROM tag
+		WHERE IFNULL(parent_id, 0) == ? AND name == ? AND deleted IS NULL
+	`, parentID, tag)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, false)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if len(tags) == 0 {
+		return nil, ErrNotExists
+	}
+
+	return tags[0], nil
+}
+
+// GetTagByPath returns the live tag at a path like finance/taxes.
+func (d *DB) GetTagByPath(path string) (*Tag, error) {
+	res, err := d.d.Query(liveTagTree+`
+		SELECT tag_id, parent_id, name, path FROM tag_tree
+		WHERE path == ?
+	`, path)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, true)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if len(tags) == 0 {
+		return nil, ErrNotExists
+	}
+
+	return tags[0], nil
+}
+
+// FindTag returns a live tag with the given name anywhere in the tag
+// hierarchy. If more than one tag has the name, the one nearest the top is
+// returned.
+func (d *DB) FindTag(tag string) (*Tag, error) {
+	res, err := d.d.Query(liveTagTree+`
+		SELECT tag_id, parent_id, name, path FROM tag_tree
+		WHERE name == ?
+		ORDER BY LENGTH(path) - LENGTH(REPLACE(path, '`+TagPathSeparator+`', '')), tag_id
+		LIMIT 1
+	`, tag)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, true)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if len(tags) == 0 {
+		return nil, ErrNotExists
+	}
+
+	return tags[0], nil
+}
+
+// AddTag adds a tag under a parent tag, or at the top level if parentID is
+// 0, returning the existing tag's ID if it's already there. Tags in the
+// trash don't hold on to their names, so a trashed tag with the same name
+// and parent is left in the trash.
+func (d *DB) AddTag(parentID uint64, tag string) (uint64, error) {
 	var tagID uint64
-	var tagName string
-	err = res.Scan(&tagID, &tagName)
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		tagID, err = addTag(tx, parentID, tag)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return 0, translateErr(err)
 	}
 
-	return &Tag{
-		ID:   tagID,
-		Name: tagName,
-	}, nil
+	return tagID, nil
 }
 
-func (d *DB) AddTag(tag string) (uint64, error) {
+// AddTagPath adds every tag along a path like finance/taxes that doesn't
+// exist yet, returning the ID of the last one.
+func (d *DB) AddTagPath(path string) (uint64, error) {
 	var tagID uint64
-	res, err := d.d.Query("SELECT tag_id FROM tag WHERE name == ?", tag)
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		tagID, err = addTagPath(tx, path)
+		return err
+	})
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	return tagID, nil
+}
+
+func addTag(tx *sql.Tx, parentID uint64, tag string) (uint64, error) {
+	_, err := tx.Exec(
+		"INSERT OR IGNORE INTO tag (parent_id, name) VALUES (?, ?)",
+		nullTagID(parentID), tag,
+	)
 	if err != nil {
 		return 0, err
 	}
-	defer res.Close()
-	if !res.Next() {
-		res, err := d.d.Exec("INSERT INTO tag (name) VALUES (?)", tag)
+
+	var tagID uint64
+	err = tx.QueryRow(`
+		SELECT tag_id FROM tag
+		WHERE IFNULL(parent_id, 0) == ? AND name == ? AND deleted IS NULL
+	`, parentID, tag).Scan(&tagID)
+	if err != nil {
+		return 0, err
+	}
+
+	return tagID, nil
+}
+
+func addTagPath(tx *sql.Tx, path string) (uint64, error) {
+	var tagID uint64
+	for _, name := range strings.Split(path, TagPathSeparator) {
+		if name == "" {
+			continue
+		}
+
+		var err error
+		tagID, err = addTag(tx, tagID, name)
 		if err != nil {
 			return 0, err
 		}
+	}
+
+	if tagID == 0 {
+		return 0, ErrConstraint
+	}
+
+	return tagID, nil
+}
+
+// RemoveTag moves a tag to the trash. ErrNotEmpty is returned if the tag
+// still has live documents or live nested tags, which have to be untagged or
+// removed first. Documents already in the trash keep the tag, and nested
+// tags already in the trash stay under it.
+func (d *DB) RemoveTag(parentID uint64, tag string, deleted time.Time) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		var tagID uint64
+		err := tx.QueryRow(`
+			SELECT tag_id FROM tag
+			WHERE IFNULL(parent_id, 0) == ? AND name == ? AND deleted IS NULL
+		`, parentID, tag).Scan(&tagID)
+		if err != nil {
+			return err
+		}
 
-		id, err := res.LastInsertId()
+		var inUse bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM doc_tag
+				INNER JOIN doc ON doc.doc_id == doc_tag.doc_id
+				WHERE doc_tag.tag_id == ? AND doc.deleted IS NULL
+			) OR EXISTS (
+				SELECT 1 FROM tag
+				WHERE parent_id == ? AND deleted IS NULL
+			)
+		`, tagID, tagID).Scan(&inUse)
 		if err != nil {
-			return 0, err
+			return err
+		} else if inUse {
+			return ErrNotEmpty
+		}
+
+		_, err = tx.Exec(
+			"UPDATE tag SET deleted = ? WHERE tag_id == ?",
+			deleted.UTC(), tagID,
+		)
+		return err
+	})
+}
+
+// MoveTag renames a tag and moves it under a new parent, or to the top
+// level if parentID is 0. A tag can't be moved under itself or one of its
+// descendants, or onto the name of another live tag.
+func (d *DB) MoveTag(tagID uint64, parentID uint64, name string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := checkTagParent(tx, tagID, parentID)
+		if err != nil {
+			return err
 		}
-		return uint64(id), nil
+
+		res, err := tx.Exec(`
+			UPDATE tag SET parent_id = ?, name = ?
+			WHERE tag_id == ? AND deleted IS NULL
+		`, nullTagID(parentID), name, tagID)
+		if err != nil {
+			return err
+		}
+
+		moved, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if moved == 0 {
+			return ErrNotExists
+		}
+
+		return nil
+	})
+}
+
+// checkTagParent returns ErrConstraint if parentID is tagID or one of its
+// descendants, which would make the tag its own ancestor.
+func checkTagParent(tx *sql.Tx, tagID uint64, parentID uint64) error {
+	if parentID == 0 {
+		return nil
 	}
 
-	err = res.Scan(&tagID)
+	var loops bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE ancestor(tag_id) AS (
+			SELECT ?
+			UNION
+			SELECT tag.parent_id FROM tag
+			INNER JOIN ancestor ON tag.tag_id == ancestor.tag_id
+			WHERE tag.parent_id IS NOT NULL
+		)
+		SELECT COUNT(*) > 0 FROM ancestor WHERE tag_id == ?
+	`, parentID, tagID).Scan(&loops)
 	if err != nil {
-		return 0, err
+		return err
+	} else if loops {
+		return ErrConstraint
 	}
 
-	return uint64(tagID), nil
+	return nil
 }
 
-func (d *DB) RemoveTag(tag string) error {
-	_, err := d.d.Exec("DELETE FROM tag WHERE name == ?", tag)
+// MergeTag merges a tag into another one. The documents and nested tags of
+// the merged tag are moved to the tag it's merged into, merging nested tags
+// with the same name as well, and then the merged tag is removed. A tag
+// can't be merged into one of its descendants.
+func (d *DB) MergeTag(tagID uint64, intoID uint64) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := checkTagParent(tx, tagID, intoID)
+		if err != nil {
+			return err
+		}
+
+		return mergeTag(tx, tagID, intoID)
+	})
+}
+
+func mergeTag(tx *sql.Tx, tagID uint64, intoID uint64) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO doc_tag (tag_id, doc_id)
+		SELECT ?, doc_id FROM doc_tag WHERE tag_id == ?
+	`, intoID, tagID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM doc_tag WHERE tag_id == ?", tagID)
+	if err != nil {
+		return err
+	}
+
+	// Documents still being written into the merged tag get the tag it's
+	// merged into once they're filed.
+	_, err = tx.Exec("UPDATE scratch SET tag_id = ? WHERE tag_id == ?", intoID, tagID)
 	if err != nil {
 		return err
 	}
+
+	err = mergeChildTags(tx, tagID, intoID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tag WHERE tag_id == ?", tagID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// mergeChildTags moves the tags under tagID to intoID. When intoID already
+// has a live tag with the same name as a live child the child is merged into
+// it. Trashed tags don't hold on to their names, so trashed children are
+// moved as they are.
+func mergeChildTags(tx *sql.Tx, tagID uint64, intoID uint64) error {
+	res, err := tx.Query(`
+		SELECT child.tag_id, IFNULL(existing.tag_id, 0)
+		FROM tag AS child
+		LEFT JOIN tag AS existing
+			ON existing.parent_id == ? AND existing.name == child.name
+			AND existing.deleted IS NULL AND child.deleted IS NULL
+		WHERE child.parent_id == ?
+	`, intoID, tagID)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	type childTag struct {
+		id, existingID uint64
+	}
+
+	var children []childTag
+	for res.Next() {
+		var child childTag
+		err = res.Scan(&child.id, &child.existingID)
+		if err != nil {
+			return err
+		}
+		children = append(children, child)
+	}
+	res.Close()
+
+	for _, child := range children {
+		if child.existingID != 0 {
+			err = mergeTag(tx, child.id, child.existingID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE tag SET parent_id = ? WHERE tag_id == ?", intoID, child.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Doc Tags
+
+const tagDocColumns = `doc.doc_id, doc.year, doc.month, doc.day, doc.uuid,
+	doc.filename, doc.checksum, doc.created, doc.deleted`
+
+// tagDocs builds the condition and arguments for the live docs that have a
+// tag, or any of the live tags under it too if descendants is set.
+func tagDocs(tagID uint64, descendants bool) (string, string, []interface{}) {
+	with := `
+		WITH RECURSIVE sub_tag(tag_id) AS (
+			SELECT ?
+			UNION
+			SELECT tag.tag_id FROM tag
+			INNER JOIN sub_tag ON tag.parent_id == sub_tag.tag_id
+			WHERE tag.deleted IS NULL AND ?
+		)`
+	where := `doc.deleted IS NULL AND doc.doc_id IN (
+		SELECT doc_id FROM doc_tag
+		WHERE tag_id IN (SELECT tag_id FROM sub_tag)
+	)`
+
+	return with, where, []interface{}{tagID, descendants}
+}
+
+// GetTagDocs returns the docs that have a tag. If descendants is set, docs
+// that have any tag nested under it are included as well.
+func (d *DB) GetTagDocs(tagID uint64, descendants bool) ([]*Doc, error) {
+	with, where, args := tagDocs(tagID, descendants)
+	res, err := d.d.Query(with+`
+		SELECT `+tagDocColumns+`
+		FROM doc
+		WHERE `+where+`
+		ORDER BY doc.doc_id
+	`, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (d *DB) GetTagDocByName(tagID uint64, name string, descendants bool) (*Doc, error) {
+	with, where, args := tagDocs(tagID, descendants)
+	res, err := d.d.Query(with+`
+		SELECT `+tagDocColumns+`
+		FROM doc
+		WHERE `+where+` AND doc.filename == ?
+		ORDER BY doc.doc_id
+		LIMIT 1
+	`, append(args, name)...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
+
+func (d *DB) TagDoc(tagID uint64, docID uint64) error {
+	_, err := d.d.Exec(
+		"INSERT OR IGNORE INTO doc_tag (tag_id, doc_id) VALUES (?, ?)",
+		tagID, docID,
+	)
+	if err != nil {
+		return translateErr(err)
+	}
+
 	return nil
 }
+
+func (d *DB) UntagDoc(tagID uint64, docID uint64) error {
+	_, err := d.d.Exec(
+		"DELETE FROM doc_tag WHERE tag_id == ? AND doc_id == ?",
+		tagID, docID,
+	)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	return nil
+}
+
+// GetDocTags returns the live tags a doc has, with their paths.
+func (d *DB) GetDocTags(docID uint64) ([]*Tag, error) {
+	res, err := d.d.Query(liveTagTree+`
+		SELECT tag_tree.tag_id, tag_tree.parent_id, tag_tree.name, tag_tree.path
+		FROM tag_tree
+		INNER JOIN doc_tag ON doc_tag.tag_id == tag_tree.tag_id
+		WHERE doc_tag.doc_id == ?
+		ORDER BY tag_tree.path
+	`, docID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, true)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return tags, nil
+}
+
+// SetDocTags replaces a doc's live tags with the tags at the given paths,
+// adding any tags that don't exist yet.
+func (d *DB) SetDocTags(docID uint64, paths []string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(liveTagTree+`
+			DELETE FROM doc_tag
+			WHERE doc_id == ? AND tag_id IN (SELECT tag_id FROM tag_tree)
+		`, docID)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			tagID, err := addTagPath(tx, path)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(
+				"INSERT OR IGNORE INTO doc_tag (tag_id, doc_id) VALUES (?, ?)",
+				tagID, docID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// tagFilter builds the condition and arguments for docs that have every tag
+// in include and none of the tags in exclude.
+func tagFilter(include []uint64, exclude []uint64) (string, []interface{}) {
+	var args []interface{}
+	where := "doc.deleted IS NULL"
+
+	if len(include) > 0 {
+		where += ` AND doc.doc_id IN (
+			SELECT doc_id FROM doc_tag
+			WHERE tag_id IN (` + placeholders(len(include)) + `)
+			GROUP BY doc_id
+			HAVING COUNT(DISTINCT tag_id) == ?
+		)`
+		// Count each tag once so a tag that's included twice doesn't
+		// filter out every document.
+		distinct := map[uint64]struct{}{}
+		for _, id := range include {
+			args = append(args, id)
+			distinct[id] = struct{}{}
+		}
+		args = append(args, len(distinct))
+	}
+
+	if len(exclude) > 0 {
+		where += ` AND doc.doc_id NOT IN (
+			SELECT doc_id FROM doc_tag
+			WHERE tag_id IN (` + placeholders(len(exclude)) + `)
+		)`
+		for _, id := range exclude {
+			args = append(args, id)
+		}
+	}
+
+	return where, args
+}
+
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
+
+// GetFilteredDocs returns the docs that have every tag in include and none of
+// the tags in exclude.
+func (d *DB) GetFilteredDocs(include []uint64, exclude []uint64) ([]*Doc, error) {
+	where, args := tagFilter(include, exclude)
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE `+where+`
+		ORDER BY doc.doc_id
+	`, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (d *DB) GetFilteredDocByName(include []uint64, exclude []uint64, name string) (*Doc, error) {
+	where, args := tagFilter(include, exclude)
+	res, err := d.d.Query(`
+		SELECT `+docColumns+`
+		FROM doc
+		WHERE `+where+` AND doc.filename == ?
+		ORDER BY doc.doc_id
+		LIMIT 1
+	`, append(args, name)...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, ErrNotExists
+	}
+
+	return scanDoc(res)
+}
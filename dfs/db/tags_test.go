@@ -0,0 +1,612 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestTagDB opens an in-memory database, with the search index when
+// docfs is built with search, and files the docs 1 to count under the same
+// day.
+func openTestTagDB(t *testing.T, count int) *DB {
+	t.Helper()
+
+	raw := openTestDB(t)
+	err := migrateDb(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrateSearch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &DB{d: raw}
+	err = d.AddDay(2017, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= count; id++ {
+		execAll(t, raw, fmt.Sprintf(`
+			INSERT INTO doc (doc_id, year, month, day, uuid, filename, checksum, created)
+			VALUES (%d, 2017, 4, 8, 'uuid-%d', 'doc-%d.pdf', 'sum-%d', '2017-04-08 10:00:00')
+		`, id, id, id, id))
+	}
+
+	return d
+}
+
+// tagState returns the docs of every live tag by path, and the paths of
+// the tags in the trash.
+func tagState(t *testing.T, d *DB) (map[string][]uint64, []string) {
+	t.Helper()
+
+	tags, err := d.GetTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := make(map[string][]uint64)
+	paths := make(map[uint64]string)
+	for _, tag := range tags {
+		docs, err := d.GetTagDocs(tag.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		docIDs := make([]uint64, 0)
+		for _, doc := range docs {
+			docIDs = append(docIDs, doc.ID)
+		}
+		sort.Slice(docIDs, func(i, j int) bool { return docIDs[i] < docIDs[j] })
+
+		live[tag.Path] = docIDs
+		paths[tag.ID] = tag.Path
+	}
+
+	trashedTags, err := d.GetTrashedTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashed := make([]string, 0)
+	for _, tag := range trashedTags {
+		if tag.ParentID == 0 {
+			trashed = append(trashed, tag.Name)
+		} else {
+			trashed = append(trashed, paths[tag.ParentID]+TagPathSeparator+tag.Name)
+		}
+	}
+	sort.Strings(trashed)
+
+	return live, trashed
+}
+
+func TestMergeTag(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// tags maps the path of each tag to create to the docs it has.
+		tags map[string][]uint64
+		// trash lists the tags moved to the trash, in order.
+		trash []string
+
+		from string
+		into string
+		err  error
+
+		want        map[string][]uint64
+		wantTrashed []string
+	}{
+		{
+			name: "overlapping docs",
+			tags: map[string][]uint64{
+				"a": {1, 2},
+				"b": {2, 3},
+			},
+			from: "a",
+			into: "b",
+			want: map[string][]uint64{
+				"b": {1, 2, 3},
+			},
+			wantTrashed: []string{},
+		},
+		{
+			name: "same named children",
+			tags: map[string][]uint64{
+				"a":     {},
+				"a/x":   {1, 2},
+				"a/y":   {3},
+				"a/x/z": {1},
+				"b":     {4},
+				"b/x":   {2, 4},
+				"b/x/z": {4},
+			},
+			from: "a",
+			into: "b",
+			want: map[string][]uint64{
+				"b":     {4},
+				"b/x":   {1, 2, 4},
+				"b/x/z": {1, 4},
+				"b/y":   {3},
+			},
+			wantTrashed: []string{},
+		},
+		{
+			name: "nested tag into its parent",
+			tags: map[string][]uint64{
+				"a":   {1},
+				"a/b": {2},
+			},
+			from: "a/b",
+			into: "a",
+			want: map[string][]uint64{
+				"a": {1, 2},
+			},
+			wantTrashed: []string{},
+		},
+		{
+			name: "trashed child",
+			tags: map[string][]uint64{
+				"a":   {1},
+				"a/x": {},
+				"b":   {},
+			},
+			trash: []string{"a/x"},
+			from:  "a",
+			into:  "b",
+			want: map[string][]uint64{
+				"b": {1},
+			},
+			wantTrashed: []string{"b/x"},
+		},
+		{
+			name: "child onto trashed child",
+			tags: map[string][]uint64{
+				"a":   {},
+				"a/x": {1},
+				"b":   {},
+				"b/x": {},
+			},
+			trash: []string{"b/x"},
+			from:  "a",
+			into:  "b",
+			want: map[string][]uint64{
+				"b":   {},
+				"b/x": {1},
+			},
+			wantTrashed: []string{"b/x"},
+		},
+		{
+			name: "trashed child onto child",
+			tags: map[string][]uint64{
+				"a":   {},
+				"a/x": {},
+				"b":   {},
+				"b/x": {2},
+			},
+			trash: []string{"a/x"},
+			from:  "a",
+			into:  "b",
+			want: map[string][]uint64{
+				"b":   {},
+				"b/x": {2},
+			},
+			wantTrashed: []string{"b/x"},
+		},
+		{
+			name: "into descendant",
+			tags: map[string][]uint64{
+				"a":   {1},
+				"a/b": {2},
+			},
+			from: "a",
+			into: "a/b",
+			err:  ErrConstraint,
+			want: map[string][]uint64{
+				"a":   {1},
+				"a/b": {2},
+			},
+			wantTrashed: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 4)
+
+			ids := make(map[string]uint64)
+			for path, docIDs := range tc.tags {
+				tagID, err := d.AddTagPath(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[path] = tagID
+
+				for _, docID := range docIDs {
+					err = d.TagDoc(tagID, docID)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, path := range tc.trash {
+				tag, err := d.GetTagByPath(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = d.RemoveTag(tag.ParentID, tag.Name, time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := d.MergeTag(ids[tc.from], ids[tc.into])
+			if err != tc.err {
+				t.Errorf("MergeTag(%s, %s) = %v, want %v", tc.from, tc.into, err, tc.err)
+			}
+
+			live, trashed := tagState(t, d)
+			if !reflect.DeepEqual(live, tc.want) {
+				t.Errorf("tags = %v, want %v", live, tc.want)
+			}
+			if !reflect.DeepEqual(trashed, tc.wantTrashed) {
+				t.Errorf("trashed tags = %v, want %v", trashed, tc.wantTrashed)
+			}
+		})
+	}
+}
+
+func TestMoveTag(t *testing.T) {
+	tests := []struct {
+		name string
+
+		tags  []string
+		trash []string
+
+		from string
+		into string
+		to   string
+		err  error
+
+		want []string
+	}{
+		{
+			name: "rename",
+			tags: []string{"a/x", "b"},
+			from: "a/x",
+			into: "a",
+			to:   "y",
+			want: []string{"a", "a/y", "b"},
+		},
+		{
+			name: "move with nested tags",
+			tags: []string{"a/x/z", "b"},
+			from: "a/x",
+			into: "b",
+			to:   "x",
+			want: []string{"a", "b", "b/x", "b/x/z"},
+		},
+		{
+			name: "onto live tag",
+			tags: []string{"a", "b"},
+			from: "a",
+			to:   "b",
+			err:  ErrExists,
+			want: []string{"a", "b"},
+		},
+		{
+			name:  "onto trashed tag",
+			tags:  []string{"a", "b"},
+			trash: []string{"b"},
+			from:  "a",
+			to:    "b",
+			want:  []string{"b"},
+		},
+		{
+			name: "under descendant",
+			tags: []string{"a/x"},
+			from: "a",
+			into: "a/x",
+			to:   "a",
+			err:  ErrConstraint,
+			want: []string{"a", "a/x"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+
+			for _, path := range tc.tags {
+				_, err := d.AddTagPath(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, path := range tc.trash {
+				err := d.RemoveTag(0, path, time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			from, err := d.GetTagByPath(tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var intoID uint64
+			if tc.into != "" {
+				into, err := d.GetTagByPath(tc.into)
+				if err != nil {
+					t.Fatal(err)
+				}
+				intoID = into.ID
+			}
+
+			err = d.MoveTag(from.ID, intoID, tc.to)
+			if err != tc.err {
+				t.Errorf("MoveTag(%s, %s, %s) = %v, want %v", tc.from, tc.into, tc.to, err, tc.err)
+			}
+
+			live, _ := tagState(t, d)
+			paths := make([]string, 0)
+			for path := range live {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tc.want) {
+				t.Errorf("tags = %v, want %v", paths, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetDocTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		err   error
+
+		want []string
+	}{
+		{
+			name:  "replace",
+			paths: []string{"b", "c"},
+			want:  []string{"b", "c"},
+		},
+		{
+			name:  "nested",
+			paths: []string{"a/x/y"},
+			want:  []string{"a/x/y"},
+		},
+		{
+			name:  "duplicate",
+			paths: []string{"c", "/c/"},
+			want:  []string{"c"},
+		},
+		{
+			name: "clear",
+			want: []string{},
+		},
+		{
+			name:  "empty path",
+			paths: []string{"c", "/"},
+			err:   ErrConstraint,
+			want:  []string{"a", "b"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 1)
+
+			for _, path := range []string{"a", "b"} {
+				tagID, err := d.AddTagPath(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = d.TagDoc(tagID, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The doc keeps its link to a tag in the trash, which isn't one
+			// of its live tags.
+			oldID, err := d.AddTag(0, "old")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.RemoveTag(0, "old", testTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			execAll(t, d.d, fmt.Sprintf("INSERT INTO doc_tag (tag_id, doc_id) VALUES (%d, 1)", oldID))
+
+			err = d.SetDocTags(1, tc.paths)
+			if err != tc.err {
+				t.Errorf("SetDocTags(%v) = %v, want %v", tc.paths, err, tc.err)
+			}
+
+			tags, err := d.GetDocTags(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := make([]string, 0)
+			for _, tag := range tags {
+				paths = append(paths, tag.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.want) {
+				t.Errorf("tags = %v, want %v", paths, tc.want)
+			}
+
+			trashed := queryInts(t, d.d, fmt.Sprintf("SELECT tag_id FROM doc_tag WHERE doc_id == 1 AND tag_id == %d", oldID))
+			if len(trashed) != 1 {
+				t.Error("doc lost its link to the tag in the trash")
+			}
+		})
+	}
+}
+
+func TestGetFilteredDocs(t *testing.T) {
+	tags := map[string][]uint64{
+		"taxes":              {1, 2, 3},
+		"receipts":           {1, 2},
+		"draft":              {2},
+		"2017":               {3},
+		"finance/taxes/2017": {1},
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []uint64
+	}{
+		{
+			name:    "include",
+			include: []string{"taxes", "receipts"},
+			want:    []uint64{1, 2},
+		},
+		{
+			name:    "repeated include",
+			include: []string{"taxes", "taxes"},
+			want:    []uint64{1, 2, 3},
+		},
+		{
+			name:    "repeated include with another tag",
+			include: []string{"taxes", "receipts", "taxes"},
+			want:    []uint64{1, 2},
+		},
+		{
+			name:    "exclude",
+			include: []string{"taxes"},
+			exclude: []string{"draft"},
+			want:    []uint64{1, 3},
+		},
+		{
+			name:    "repeated exclude",
+			include: []string{"taxes"},
+			exclude: []string{"draft", "draft"},
+			want:    []uint64{1, 3},
+		},
+		{
+			name:    "included and excluded",
+			include: []string{"taxes"},
+			exclude: []string{"taxes"},
+			want:    []uint64{},
+		},
+		{
+			name:    "shadowed nested name",
+			include: []string{"taxes", "2017"},
+			want:    []uint64{3},
+		},
+		{
+			name:    "nested path",
+			include: []string{"taxes", "finance/taxes/2017"},
+			want:    []uint64{1},
+		},
+	}
+
+	d := openTestTagDB(t, 4)
+	for path, docIDs := range tags {
+		tagID, err := d.AddTagPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, docID := range docIDs {
+			err = d.TagDoc(tagID, docID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Filters name tags the way lookups in a tag directory do, by the
+	// shallowest tag with a name or by a full path.
+	tagID := func(name string) uint64 {
+		var tag *Tag
+		var err error
+		if strings.Contains(name, TagPathSeparator) {
+			tag, err = d.GetTagByPath(name)
+		} else {
+			tag, err = d.FindTag(name)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		return tag.ID
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var include, exclude []uint64
+			for _, name := range tc.include {
+				include = append(include, tagID(name))
+			}
+			for _, name := range tc.exclude {
+				exclude = append(exclude, tagID(name))
+			}
+
+			docs, err := d.GetFilteredDocs(include, exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			docIDs := make([]uint64, 0)
+			for _, doc := range docs {
+				docIDs = append(docIDs, doc.ID)
+			}
+			if !reflect.DeepEqual(docIDs, tc.want) {
+				t.Errorf("docs = %v, want %v", docIDs, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindTag(t *testing.T) {
+	d := openTestTagDB(t, 0)
+	for _, path := range []string{"finance/taxes/2017", "2017", "home/2017", "home/bills"} {
+		_, err := d.AddTagPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "2017", want: "2017"},
+		{name: "taxes", want: "finance/taxes"},
+		{name: "bills", want: "home/bills"},
+		{name: "missing", err: ErrNotExists},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tag, err := d.FindTag(tc.name)
+			if err != tc.err {
+				t.Fatalf("FindTag(%s) = %v, want %v", tc.name, err, tc.err)
+			} else if err != nil {
+				return
+			}
+
+			if tag.Path != tc.want {
+				t.Errorf("FindTag(%s) = %s, want %s", tc.name, tag.Path, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TrashDoc moves a doc to the trash. The doc keeps its date and tags so it
+// can be restored with RestoreDoc.
+func (d *DB) TrashDoc(docID uint64, deleted time.Time) error {
+	res, err := d.d.Exec(
+		"UPDATE doc SET deleted = ? WHERE doc_id == ? AND deleted IS NULL",
+		deleted.UTC(), docID,
+	)
+	if err != nil {
+		return translateErr(err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return translateErr(err)
+	} else if removed == 0 {
+		return ErrNotExists
+	}
+
+	return nil
+}
+
+func (d *DB) GetTrashedDocs() ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT ` + docColumns + `
+		FROM doc
+		WHERE deleted IS NOT NULL
+		ORDER BY doc_id
+	`)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// RestoreDoc takes a doc out of the trash, filing it under the given date
+// and name. The date is added if it doesn't exist anymore.
+func (d *DB) RestoreDoc(docID uint64, year, month, day uint64, name string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := addDay(tx, year, month, day)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`
+			UPDATE doc
+			SET deleted = NULL, year = ?, month = ?, day = ?, filename = ?
+			WHERE doc_id == ? AND deleted IS NOT NULL
+		`, year, month, day, name, docID)
+		if err != nil {
+			return err
+		}
+
+		restored, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if restored == 0 {
+			return ErrNotExists
+		}
+
+		return nil
+	})
+}
+
+func (d *DB) GetTrashedTags() ([]*Tag, error) {
+	res, err := d.d.Query(`
+		SELECT tag_id, parent_id, name
+		FROM tag
+		WHERE deleted IS NOT NULL
+		ORDER BY tag_id
+	`)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, false)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+
+	return tags, nil
+}
+
+// GetTrashedTag returns a tag that's in the trash, or ErrNotExists if the
+// tag isn't in the trash.
+func (d *DB) GetTrashedTag(tagID uint64) (*Tag, error) {
+	res, err := d.d.Query(`
+		SELECT tag_id, parent_id, name
+		FROM tag
+		WHERE tag_id == ? AND deleted IS NOT NULL
+	`, tagID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	tags, err := scanTags(res, false)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if len(tags) == 0 {
+		return nil, ErrNotExists
+	}
+
+	return tags[0], nil
+}
+
+// GetTrashedTagDocs returns the docs in the trash that have a tag.
+func (d *DB) GetTrashedTagDocs(tagID uint64) ([]*Doc, error) {
+	res, err := d.d.Query(`
+		SELECT `+tagDocColumns+`
+		FROM doc
+		INNER JOIN doc_tag ON doc_tag.doc_id == doc.doc_id
+		WHERE doc_tag.tag_id == ? AND doc.deleted IS NOT NULL
+		ORDER BY doc.doc_id
+	`, tagID)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer res.Close()
+
+	docs := make([]*Doc, 0)
+	for res.Next() {
+		doc, err := scanDoc(res)
+		if err != nil {
+			return nil, translateErr(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// RestoreTag takes a tag out of the trash, putting it under a parent tag, or
+// at the top level if parentID is 0. Nested tags that were removed before it
+// stay in the trash. ErrExists is returned if the parent already has a live
+// tag with that name.
+func (d *DB) RestoreTag(tagID uint64, parentID uint64, name string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		err := checkTagParent(tx, tagID, parentID)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`
+			UPDATE tag
+			SET deleted = NULL, parent_id = ?, name = ?
+			WHERE tag_id == ? AND deleted IS NOT NULL
+		`, nullTagID(parentID), name, tagID)
+		if err != nil {
+			return err
+		}
+
+		restored, err := res.RowsAffected()
+		if err != nil {
+			return err
+		} else if restored == 0 {
+			return ErrNotExists
+		}
+
+		return nil
+	})
+}
+
+// PurgeDoc permanently removes a doc in the trash. The checksums of the
+// doc's revisions are returned so their contents can be cleaned up.
+func (d *DB) PurgeDoc(docID uint64) ([]string, error) {
+	var purged []string
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		purged, err = purgeDocs(tx, "doc_id == ? AND deleted IS NOT NULL", docID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// PurgeTag permanently removes a tag in the trash.
+func (d *DB) PurgeTag(tagID uint64) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return purgeTags(tx, "tag_id == ? AND deleted IS NOT NULL", tagID)
+	})
+}
+
+// PurgeTrash permanently removes docs and tags that were moved to the trash
+// before the given time. The checksums of the purged docs' revisions are
+// returned so their contents can be cleaned up.
+func (d *DB) PurgeTrash(before time.Time) ([]string, error) {
+	var purged []string
+	err := d.withTx(func(tx *sql.Tx) error {
+		var err error
+		purged, err = purgeDocs(tx, "deleted < ?", before.UTC())
+		if err != nil {
+			return err
+		}
+
+		return purgeTags(tx, "deleted < ?", before.UTC())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// purgeDocs removes the docs matching where along with their revisions and
+// tags. Docs with a new revision still being written are skipped, while
+// revisions left in lost+found are kept there without the doc.
+func purgeDocs(tx *sql.Tx, where string, args ...interface{}) ([]string, error) {
+	where = "(" + where + `) AND doc_id NOT IN (
+		SELECT doc_id FROM scratch
+		WHERE doc_id IS NOT NULL AND state IN (?, ?)
+	)`
+	args = append(append([]interface{}{}, args...), ScratchOpen, ScratchClosed)
+
+	res, err := tx.Query(`
+		SELECT DISTINCT checksum FROM revision
+		WHERE doc_id IN (SELECT doc_id FROM doc WHERE `+where+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	checksums := make([]string, 0)
+	for res.Next() {
+		var checksum string
+		err = res.Scan(&checksum)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	res.Close()
+
+	_, err = tx.Exec(`
+		UPDATE scratch SET doc_id = NULL
+		WHERE doc_id IN (SELECT doc_id FROM doc WHERE `+where+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range []string{"doc_tag", "doc_meta", "revision"} {
+		_, err = tx.Exec(`
+			DELETE FROM `+table+`
+			WHERE doc_id IN (SELECT doc_id FROM doc WHERE `+where+`)
+		`, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = unindexDocs(tx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM doc WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return checksums, nil
+}
+
+// purgeTags removes the tags matching where, the tags nested under them and
+// their doc associations. Tags are skipped if new documents are still being
+// written into them or any tag under them, while documents left in
+// lost+found are kept there without the tag.
+func purgeTags(tx *sql.Tx, where string, args ...interface{}) error {
+	res, err := tx.Query("SELECT tag_id FROM tag WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	var tagIDs []uint64
+	for res.Next() {
+		var tagID uint64
+		err = res.Scan(&tagID)
+		if err != nil {
+			return err
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+	res.Close()
+
+	const subTags = `
+		WITH RECURSIVE sub_tag(tag_id) AS (
+			SELECT tag_id FROM tag WHERE tag_id == ?
+			UNION
+			SELECT tag.tag_id FROM tag
+			INNER JOIN sub_tag ON tag.parent_id == sub_tag.tag_id
+		)`
+
+	for _, tagID := range tagIDs {
+		var busy bool
+		err = tx.QueryRow(subTags+`
+			SELECT COUNT(*) > 0 FROM scratch
+			WHERE tag_id IN (SELECT tag_id FROM sub_tag) AND state IN (?, ?)
+		`, tagID, ScratchOpen, ScratchClosed).Scan(&busy)
+		if err != nil {
+			return err
+		} else if busy {
+			continue
+		}
+
+		_, err = tx.Exec(subTags+`
+			UPDATE scratch SET tag_id = NULL
+			WHERE tag_id IN (SELECT tag_id FROM sub_tag)
+		`, tagID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(subTags+`
+			DELETE FROM doc_tag
+			WHERE tag_id IN (SELECT tag_id FROM sub_tag)
+		`, tagID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(subTags+`
+			DELETE FROM tag
+			WHERE tag_id IN (SELECT tag_id FROM sub_tag)
+		`, tagID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
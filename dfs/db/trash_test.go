@@ -0,0 +1,292 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreDoc(t *testing.T) {
+	tests := []struct {
+		name string
+
+		trash bool
+		day   uint64
+		to    string
+		err   error
+
+		wantDay  uint64
+		wantName string
+	}{
+		{
+			name:     "same day",
+			trash:    true,
+			day:      8,
+			to:       "a.pdf",
+			wantDay:  8,
+			wantName: "a.pdf",
+		},
+		{
+			name:     "new day",
+			trash:    true,
+			day:      9,
+			to:       "b.pdf",
+			wantDay:  9,
+			wantName: "b.pdf",
+		},
+		{
+			name:     "not in trash",
+			day:      9,
+			to:       "b.pdf",
+			err:      ErrNotExists,
+			wantDay:  8,
+			wantName: "a.pdf",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+			docID := addTestDoc(t, d, 8, "a.pdf", "one")
+
+			tagID, err := d.AddTag(0, "taxes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.TagDoc(tagID, docID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.trash {
+				err = d.TrashDoc(docID, testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = d.RestoreDoc(docID, 2017, 4, tc.day, tc.to)
+			if err != tc.err {
+				t.Errorf("RestoreDoc() = %v, want %v", err, tc.err)
+			}
+
+			doc, err := d.GetDocByName(2017, 4, tc.wantDay, tc.wantName)
+			if err != nil {
+				t.Fatal(err)
+			} else if doc.ID != docID {
+				t.Errorf("doc = %d, want %d", doc.ID, docID)
+			}
+
+			tags, err := d.GetDocTags(docID)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(tags) != 1 || tags[0].ID != tagID {
+				t.Errorf("tags = %v, want the tag kept", tags)
+			}
+		})
+	}
+}
+
+func TestRestoreTag(t *testing.T) {
+	tests := []struct {
+		name string
+
+		tags  []string
+		trash []string
+
+		restore string
+		into    string
+		to      string
+		err     error
+
+		want []string
+	}{
+		{
+			name:    "top level",
+			tags:    []string{"a", "b"},
+			trash:   []string{"a"},
+			restore: "a",
+			to:      "c",
+			want:    []string{"b", "c"},
+		},
+		{
+			name:    "into tag",
+			tags:    []string{"a", "b"},
+			trash:   []string{"a"},
+			restore: "a",
+			into:    "b",
+			to:      "a",
+			want:    []string{"b", "b/a"},
+		},
+		{
+			name:    "same name",
+			tags:    []string{"a"},
+			trash:   []string{"a"},
+			restore: "a",
+			to:      "a",
+			want:    []string{"a"},
+		},
+		{
+			name:    "name taken",
+			tags:    []string{"a", "b"},
+			trash:   []string{"a"},
+			restore: "a",
+			to:      "b",
+			err:     ErrExists,
+			want:    []string{"b"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+
+			ids := make(map[string]uint64)
+			for _, name := range tc.tags {
+				tagID, err := d.AddTag(0, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[name] = tagID
+			}
+
+			for _, name := range tc.trash {
+				err := d.RemoveTag(0, name, testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := d.RestoreTag(ids[tc.restore], ids[tc.into], tc.to)
+			if err != tc.err {
+				t.Errorf("RestoreTag() = %v, want %v", err, tc.err)
+			}
+
+			live, _ := tagState(t, d)
+			for _, path := range tc.want {
+				if _, ok := live[path]; !ok {
+					t.Errorf("tag %s missing from %v", path, live)
+				}
+			}
+			if len(live) != len(tc.want) {
+				t.Errorf("tags = %v, want %v", live, tc.want)
+			}
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	before := testTime.Add(time.Hour)
+
+	tests := []struct {
+		name string
+
+		// deleted is when the doc and tag were moved to the trash.
+		deleted time.Time
+		// scratch is the state of a scratch entry that refers to the
+		// doc and tag, if there is one.
+		scratch string
+
+		wantPurged bool
+	}{
+		{
+			name:       "old",
+			deleted:    testTime,
+			wantPurged: true,
+		},
+		{
+			name:    "recent",
+			deleted: before.Add(time.Hour),
+		},
+		{
+			name:    "being written",
+			deleted: testTime,
+			scratch: ScratchOpen,
+		},
+		{
+			name:    "written",
+			deleted: testTime,
+			scratch: ScratchClosed,
+		},
+		{
+			name:       "lost",
+			deleted:    testTime,
+			scratch:    ScratchLost,
+			wantPurged: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := openTestTagDB(t, 0)
+			docID := addTestDoc(t, d, 8, "a.pdf", "one", "two")
+
+			tagID, err := d.AddTag(0, "taxes")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.scratch != "" {
+				revisionID, err := d.CreateDocScratch(docID, testTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+				docScratchID, err := d.CreateScratch("b.pdf", 2017, 4, 8, testTime, tagID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, scratchID := range []uint64{revisionID, docScratchID} {
+					err = d.SetScratchState(scratchID, tc.scratch)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			err = d.TrashDoc(docID, tc.deleted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.RemoveTag(0, "taxes", tc.deleted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			purged, err := d.PurgeTrash(before)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, docErr := d.GetDoc(docID)
+			_, tagErr := d.GetTrashedTag(tagID)
+			if tc.wantPurged {
+				if len(purged) != 2 {
+					t.Errorf("purged checksums = %v, want both revisions", purged)
+				}
+				if docErr != ErrNotExists {
+					t.Errorf("GetDoc() = %v, want the doc purged", docErr)
+				}
+				if tagErr != ErrNotExists {
+					t.Errorf("GetTrashedTag() = %v, want the tag purged", tagErr)
+				}
+			} else {
+				if len(purged) != 0 {
+					t.Errorf("purged checksums = %v, want none", purged)
+				}
+				if docErr != nil {
+					t.Errorf("GetDoc() = %v, want the doc kept", docErr)
+				}
+				if tagErr != nil {
+					t.Errorf("GetTrashedTag() = %v, want the tag kept", tagErr)
+				}
+			}
+
+			scratches, err := d.GetScratches("")
+			if err != nil {
+				t.Fatal(err)
+			} else if tc.scratch != "" && len(scratches) != 2 {
+				t.Errorf("scratch entries = %d, want them kept", len(scratches))
+			}
+		})
+	}
+}
@@ -2,12 +2,14 @@ package dfs
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"strconv"
 
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
+	"github.com/google/uuid"
 	"golang.org/x/net/context"
 )
 
@@ -28,8 +30,12 @@ func newFsDocs(fs *DocFS) *fsDocs {
 }
 
 func (d *fsDocs) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = d.inode
-	attr.Mode = os.ModeDir | 0755
+	years, err := d.fs.fsdb.GetYears()
+	if err != nil {
+		return fuseError(err)
+	}
+
+	d.fs.dirAttr(attr, d.inode, 0755, len(years))
 	return nil
 }
 
@@ -38,7 +44,7 @@ func (d *fsDocs) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 	years, err := d.fs.fsdb.GetYears()
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	for _, year := range years {
@@ -54,12 +60,12 @@ func (d *fsDocs) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (d *fsDocs) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
 	year, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return nil, fuse.EPERM
+		return nil, errInvalid
 	}
 
 	err = d.fs.fsdb.AddYear(year)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
 	return newFsYear(d.fs, year), nil
@@ -67,20 +73,16 @@ func (d *fsDocs) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node
 
 func (d *fsDocs) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if !req.Dir {
-		return fuse.EIO
+		return errIsDir
 	}
 
 	year, err := strconv.ParseUint(req.Name, 10, 0)
 	if err != nil {
-		return fuse.EIO
+		return fuse.ENOENT
 	}
 
-	err = d.fs.fsdb.RemoveYear(year)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	err = d.fs.fsdb.RemoveYear(year, d.fs.cascadeRemove, d.fs.clock.Now())
+	return fuseError(err)
 }
 
 func (d *fsDocs) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
@@ -91,7 +93,7 @@ func (d *fsDocs) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
 
 	year, err = d.fs.fsdb.GetYear(year)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return nil, fuseError(err)
 	}
 
 	return newFsYear(d.fs, year), nil
@@ -106,22 +108,212 @@ type fsDoc struct {
 }
 
 func newFsDoc(fs *DocFS, id uint64, name string) *fsDoc {
-	d := &fsDoc{
-		fs: fs,
-		ID: id,
-	}
-	d.inode = fs.getInode(nDoc, id)
-	d.name = name
+	inode := fs.getInode(nDoc, id)
+	return fs.getNode(inode, func() fusefs.Node {
+		d := &fsDoc{
+			fs: fs,
+			ID: id,
+		}
+		d.inode = inode
+		d.name = name
+		return d
+	}).(*fsDoc)
+}
 
-	return d
+func (d *fsDoc) Forget() {
+	d.fs.forgetNode(d.inode, d)
 }
 
 func (d *fsDoc) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = d.inode
-	attr.Mode = 0755
+	// While a new revision is being written the document shows the
+	// contents being written.
+	if s := d.fs.getDocScratch(d.ID); s != nil {
+		err := s.Attr(ctx, attr)
+		if err != nil {
+			return err
+		}
+
+		attr.Inode = d.inode
+		return nil
+	}
+
+	doc, err := d.fs.fsdb.GetDoc(d.ID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	rev, err := d.fs.fsdb.GetLatestRevision(d.ID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	fInfo, err := d.fs.blobs.stat(rev.Checksum)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	tags, err := d.fs.fsdb.GetDocTags(d.ID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	d.fs.fileAttr(attr, d.inode, 0644, fInfo.Size(), rev.Created, doc.Created)
+	// Every tag directory the document is in is another link to it.
+	attr.Nlink += uint32(len(tags))
 	return nil
 }
 
-func moveScratchDoc() error {
+// Open opens the document's current contents for reading. Opening it for
+// writing starts a new revision that's added once every writer has closed
+// it, so the existing contents are never changed.
+func (d *fsDoc) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		truncate := req.Flags&fuse.OpenTruncate != 0
+		_, handle, err := openDocScratch(d.fs, d.ID, truncate)
+		if err != nil {
+			return nil, fuseError(err)
+		}
+
+		return handle, nil
+	}
+
+	doc, err := d.fs.fsdb.GetDoc(d.ID)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	file, err := d.fs.blobs.open(doc.Checksum)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return &fsDocHandle{
+		file: file,
+	}, nil
+}
+
+// Setattr truncates the new revision being written. Truncating a document
+// that isn't open for writing adds the truncated contents as a revision
+// straight away.
+func (d *fsDoc) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		s, _, err := openDocScratch(d.fs, d.ID, false)
+		if err != nil {
+			return fuseError(err)
+		}
+
+		err = s.truncate(int64(req.Size))
+		releaseErr := s.release()
+		if err != nil {
+			return fuseError(err)
+		} else if releaseErr != nil {
+			return fuseError(releaseErr)
+		}
+	}
+
+	return d.Attr(ctx, &resp.Attr)
+}
 
+func (d *fsDoc) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if s := d.fs.getDocScratch(d.ID); s != nil {
+		return s.Fsync(ctx, req)
+	}
+
+	return nil
+}
+
+type fsDocHandle struct {
+	file *os.File
+}
+
+func (h *fsDocHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return fuseError(err)
+	}
+
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *fsDocHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.file.Close()
+}
+
+// moveScratchDoc moves a finished scratch file into the blob store and
+// replaces its scratch entry with a doc entry.
+func moveScratchDoc(fs *DocFS, scratchID uint64, checksum string) (uint64, error) {
+	docUUID := uuid.New().String()
+
+	var docID uint64
+	err := storeScratch(fs, scratchID, checksum, func() error {
+		var err error
+		docID, err = fs.fsdb.PromoteScratch(scratchID, docUUID, checksum)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return docID, nil
+}
+
+// storeScratch moves a finished scratch file into the blob store and calls
+// promote to replace its scratch entry. If promote fails the scratch file
+// is put back so it can be promoted later.
+func storeScratch(fs *DocFS, scratchID uint64, checksum string, promote func() error) error {
+	scratchPath := fs.scratchPath(scratchID)
+
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+
+	stored, err := fs.blobs.put(scratchPath, checksum)
+	if err != nil {
+		return err
+	}
+
+	err = promote()
+	if err != nil {
+		if stored {
+			os.Rename(fs.blobs.path(checksum), scratchPath)
+		}
+		return err
+	}
+
+	if !stored {
+		// The contents were already stored for another document so the
+		// scratch file isn't needed anymore.
+		err = os.Remove(scratchPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeDocFiles removes the blobs of documents that have been removed from
+// the database, as long as no other document still uses them.
+func removeDocFiles(fs *DocFS, checksums []string) error {
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+
+	for _, checksum := range checksums {
+		refs, err := fs.fsdb.GetChecksumRefs(checksum)
+		if err != nil {
+			return err
+		}
+
+		if refs > 0 {
+			continue
+		}
+
+		err = fs.blobs.remove(checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
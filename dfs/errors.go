@@ -1,7 +1,57 @@
 package dfs
 
-import "errors"
+import (
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/aphistic/docfs/dfs/db"
+)
 
 var (
-	ErrHashFailure = errors.New("Error generating hash")
+	errNotEmpty = fuse.Errno(syscall.ENOTEMPTY)
+	errInvalid  = fuse.Errno(syscall.EINVAL)
+	errBusy     = fuse.Errno(syscall.EBUSY)
+	errReadOnly = fuse.Errno(syscall.EROFS)
+	errNotSup   = fuse.Errno(syscall.ENOTSUP)
+	errIsDir    = fuse.Errno(syscall.EISDIR)
 )
+
+// fuseError translates an error into the errno reported to the kernel.
+// Errors that are already errnos are returned unchanged and errors without
+// a better match are reported as EIO.
+func fuseError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+
+	switch err {
+	case db.ErrNotExists:
+		return fuse.ENOENT
+	case db.ErrExists:
+		return fuse.EEXIST
+	case db.ErrNotEmpty:
+		return errNotEmpty
+	case db.ErrConstraint:
+		return errInvalid
+	case db.ErrBusy:
+		return errBusy
+	case db.ErrReadOnly:
+		return errReadOnly
+	case db.ErrNotSupported:
+		return errNotSup
+	}
+
+	if os.IsNotExist(err) {
+		return fuse.ENOENT
+	} else if os.IsExist(err) {
+		return fuse.EEXIST
+	}
+
+	debugf("unexpected error: %s", err)
+	return fuse.EIO
+}
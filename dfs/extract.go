@@ -0,0 +1,520 @@
+package dfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aphistic/docfs/dfs/db"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// maxIndexSize is the most text indexed for a single document.
+const maxIndexSize = 8 << 20
+
+// extractTimeout is how long an extractor gets to extract a document before
+// it's given up on.
+const extractTimeout = 5 * time.Minute
+
+// Extractor turns the contents of a document into the text it's found by in
+// searches, along with any metadata the document has.
+type Extractor interface {
+	Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error)
+}
+
+// Extraction is what an Extractor found in a document. The title and meta
+// values are stored with the document unless it already has them, and can
+// be read as the user.docfs.title and user.docfs.meta.* attributes.
+type Extraction struct {
+	Text  string
+	Title string
+	Meta  map[string]string
+}
+
+// defaultExtractors returns the built in extractors by MIME type. A MIME
+// type like text/* is used for any type without an extractor of its own.
+func defaultExtractors() map[string]Extractor {
+	return map[string]Extractor{
+		"text/*":          textExtractor{},
+		"text/markdown":   markdownExtractor{},
+		"text/html":       htmlExtractor{},
+		"application/pdf": pdfExtractor{},
+	}
+}
+
+// extMediaTypes holds the MIME types of extensions the mime package doesn't
+// always know about.
+var extMediaTypes = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+}
+
+// docMediaType returns the MIME type of a document, going by its extension
+// if it has a known one and by its first bytes otherwise.
+func docMediaType(name string, head []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	mediaType, ok := extMediaTypes[ext]
+	if !ok && ext != "" {
+		mediaType = mime.TypeByExtension(ext)
+	}
+	if mediaType == "" {
+		mediaType = http.DetectContentType(head)
+	}
+
+	parsed, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return mediaType
+	}
+
+	return parsed
+}
+
+// getExtractor returns the extractor for a MIME type, or nil if documents
+// of the type aren't indexed.
+func (f *DocFS) getExtractor(mediaType string) Extractor {
+	if e, ok := f.extractors[mediaType]; ok {
+		return e
+	}
+
+	if idx := strings.Index(mediaType, "/"); idx >= 0 {
+		return f.extractors[mediaType[:idx]+"/*"]
+	}
+
+	return nil
+}
+
+// extractJob is a document whose contents changed and need to be extracted
+// for the search index.
+type extractJob struct {
+	docID    uint64
+	checksum string
+}
+
+// queueExtract queues a document to be extracted in the background so
+// extractors never hold up writing a document.
+func (f *DocFS) queueExtract(docID uint64, checksum string) {
+	f.extractLock.Lock()
+	f.extractJobs = append(f.extractJobs, extractJob{
+		docID:    docID,
+		checksum: checksum,
+	})
+	f.extractLock.Unlock()
+
+	select {
+	case f.extractWake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *DocFS) nextExtract() (extractJob, bool) {
+	f.extractLock.Lock()
+	defer f.extractLock.Unlock()
+
+	if len(f.extractJobs) == 0 {
+		return extractJob{}, false
+	}
+
+	job := f.extractJobs[0]
+	f.extractJobs = f.extractJobs[1:]
+	return job, true
+}
+
+// queueUnindexed queues the documents whose contents haven't been extracted
+// yet, such as ones still queued when docfs last stopped.
+func (f *DocFS) queueUnindexed() error {
+	docs, err := f.fsdb.GetUnindexedDocs()
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		f.queueExtract(doc.ID, doc.Checksum)
+	}
+
+	return nil
+}
+
+// extractLoop extracts queued documents until ctx is cancelled. Documents
+// still queued when it stops are queued again the next time docfs starts.
+func (f *DocFS) extractLoop(ctx context.Context) {
+	defer close(f.extractDone)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.extractWake:
+		}
+
+		for ctx.Err() == nil {
+			job, ok := f.nextExtract()
+			if !ok {
+				break
+			}
+
+			err := f.extractDoc(ctx, job)
+			if err != nil {
+				debugf("could not extract document %d: %s", job.docID, err)
+			}
+		}
+	}
+}
+
+// extractDoc updates the search index and metadata of a document from the
+// contents it had when it was queued.
+func (f *DocFS) extractDoc(ctx context.Context, job extractJob) error {
+	doc, err := f.fsdb.GetDoc(job.docID)
+	if err == db.ErrNotExists {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The document was written again since, and the newer contents are
+	// queued as well.
+	if doc.Checksum != job.checksum {
+		return nil
+	}
+
+	file, err := f.blobs.open(job.checksum)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 512)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	e := f.getExtractor(docMediaType(doc.Filename, head[:n]))
+	if e == nil {
+		return f.fsdb.IndexDoc(doc.ID, job.checksum, "")
+	}
+
+	extractCtx, cancel := context.WithTimeout(ctx, extractTimeout)
+	defer cancel()
+
+	extraction, err := runExtractor(extractCtx, e, file, fInfo.Size())
+	if err != nil && ctx.Err() == nil {
+		// The contents are indexed without any text so a document the
+		// extractor can't handle isn't extracted again on every start,
+		// only once it's written again.
+		indexErr := f.fsdb.IndexDoc(doc.ID, job.checksum, "")
+		if indexErr != nil {
+			return indexErr
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	meta := make(map[string]string)
+	if extraction.Title != "" {
+		meta["title"] = extraction.Title
+	}
+	for key, value := range extraction.Meta {
+		meta["meta."+key] = value
+	}
+
+	// Metadata that's already set, by an earlier revision or by hand, is
+	// left alone.
+	for key, value := range meta {
+		_, err = f.fsdb.GetDocMetaValue(doc.ID, key)
+		if err != db.ErrNotExists {
+			continue
+		}
+
+		err = f.fsdb.SetDocMeta(doc.ID, key, []byte(value))
+		if err != nil {
+			return err
+		}
+	}
+
+	// The document is only indexed once everything else is stored, so a
+	// document that's interrupted is extracted again.
+	text := extraction.Text
+	if len(text) > maxIndexSize {
+		text = text[:maxIndexSize]
+	}
+	return f.fsdb.IndexDoc(doc.ID, job.checksum, strings.ToValidUTF8(text, ""))
+}
+
+// runExtractor runs an extractor, turning a panic from a document it can't
+// handle into an error. An extractor that doesn't stop when ctx is done is
+// left to finish on its own, and reads from r fail once it's closed.
+func runExtractor(ctx context.Context, e Extractor, r io.ReaderAt, size int64) (*Extraction, error) {
+	type result struct {
+		extraction *Extraction
+		err        error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("extractor panicked: %v", p)}
+			}
+		}()
+
+		extraction, err := e.Extract(ctx, r, size)
+		done <- result{extraction: extraction, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.extraction, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readText reads up to maxIndexSize bytes of text, returning nothing if it
+// isn't valid UTF-8.
+func readText(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxIndexSize))
+	if err != nil {
+		return "", err
+	}
+
+	if !utf8.Valid(data) {
+		return "", nil
+	}
+
+	return string(data), nil
+}
+
+// textExtractor indexes plain text as it is.
+type textExtractor struct{}
+
+func (textExtractor) Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error) {
+	text, err := readText(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Extraction{
+		Text: text,
+	}, nil
+}
+
+// markdownExtractor indexes Markdown as it is, since the markup is mostly
+// punctuation that's ignored by the index anyway, and uses the first top
+// level heading as the title.
+type markdownExtractor struct{}
+
+func (markdownExtractor) Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error) {
+	text, err := readText(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	extraction := &Extraction{
+		Text: text,
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			extraction.Title = strings.TrimSpace(line[2:])
+			break
+		}
+	}
+
+	return extraction, nil
+}
+
+// htmlExtractor indexes the text of an HTML document without its markup,
+// scripts or styles. The title and the author, description and keywords
+// meta tags are used as metadata.
+type htmlExtractor struct{}
+
+func (htmlExtractor) Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error) {
+	extraction := &Extraction{
+		Meta: make(map[string]string),
+	}
+
+	var text []string
+	var skip int
+	var inTitle bool
+
+	z := html.NewTokenizer(io.LimitReader(io.NewSectionReader(r, 0, size), maxIndexSize))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			}
+
+			extraction.Text = strings.Join(text, " ")
+			return extraction, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tag := z.Token()
+			switch tag.Data {
+			case "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				var name, content string
+				for _, attr := range tag.Attr {
+					if attr.Key == "name" {
+						name = strings.ToLower(attr.Val)
+					} else if attr.Key == "content" {
+						content = attr.Val
+					}
+				}
+
+				switch name {
+				case "author", "description", "keywords":
+					if content != "" {
+						extraction.Meta[name] = content
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				if skip > 0 {
+					skip--
+				}
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+
+			value := strings.TrimSpace(string(z.Text()))
+			if value == "" {
+				continue
+			}
+
+			if inTitle && extraction.Title == "" {
+				extraction.Title = value
+			}
+			text = append(text, value)
+		}
+	}
+}
+
+// pdfExtractor indexes the text layer of a PDF. Scanned documents without
+// one need an external extractor that does OCR. The title, author, subject
+// and keywords from the document information are used as metadata.
+type pdfExtractor struct{}
+
+func (pdfExtractor) Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error) {
+	reader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pages are read one at a time so a large document can be given up on
+	// between pages, and reading stops once there's enough text to index.
+	var plain bytes.Buffer
+	fonts := make(map[string]*pdf.Font)
+	for idx := 1; idx <= reader.NumPage() && plain.Len() < maxIndexSize; idx++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		page := reader.Page(idx)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return nil, err
+		}
+		plain.WriteString(pageText)
+	}
+
+	text, err := readText(&plain)
+	if err != nil {
+		return nil, err
+	}
+
+	info := reader.Trailer().Key("Info")
+	extraction := &Extraction{
+		Text:  text,
+		Title: info.Key("Title").Text(),
+		Meta:  make(map[string]string),
+	}
+	for _, key := range []string{"Author", "Subject", "Keywords"} {
+		if value := info.Key(key).Text(); value != "" {
+			extraction.Meta[strings.ToLower(key)] = value
+		}
+	}
+
+	return extraction, nil
+}
+
+// commandExtractor pipes a document to a command and indexes what it
+// writes to stdout.
+type commandExtractor struct {
+	name string
+	args []string
+}
+
+func (c *commandExtractor) Extract(ctx context.Context, r io.ReaderAt, size int64) (*Extraction, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	cmd.Stdin = io.NewSectionReader(r, 0, size)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(stdout, maxIndexSize))
+	if err != nil {
+		cmd.Wait()
+		return nil, err
+	}
+
+	// Anything written past the limit isn't indexed, but the command
+	// still has to be able to finish writing it.
+	io.Copy(ioutil.Discard, stdout)
+
+	err = cmd.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", c.name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return &Extraction{
+		Text: string(data),
+	}, nil
+}
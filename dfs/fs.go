@@ -5,16 +5,23 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 
 	"github.com/aphistic/docfs/dfs/db"
 	"github.com/efritz/glock"
+	"golang.org/x/net/context"
 )
 
 type nodeType int
 
+// Node types are part of every inode number so new types must only be added
+// to the end of the list.
 const (
 	nRoot nodeType = iota
 	nTags
@@ -25,16 +32,77 @@ const (
 	nMonth
 	nDay
 	nScratch
+	nLostFound
+	nLost
+	nRevisions
+	nRevision
+	nTrash
+	nTrashDocs
+	nTrashTags
+	nTrashTag
+	nTagFilter
+	nSearch
+	nSearchResults
+)
+
+// Debug is called with debug messages from the filesystem. It behaves like
+// fuse.Debug and discards messages by default.
+var Debug = func(msg interface{}) {}
+
+func debugf(format string, args ...interface{}) {
+	Debug(fmt.Sprintf(format, args...))
+}
+
+const (
+	inodeTypeShift = 56
+	inodeIDMask    = (1 << inodeTypeShift) - 1
 )
 
 type DocFS struct {
-	inodeLock  sync.Mutex
-	inodeCount uint64
-	inodes     map[nodeType]map[uint64]uint64
+	nodeLock sync.Mutex
+	nodes    map[uint64]fusefs.Node
+	// keyIDs holds the IDs handed out by getKeyID, which are only kept
+	// for as long as the filesystem is mounted.
+	keyIDs map[string]uint64
+
+	scratchLock sync.Mutex
+	scratches   map[uint64]*scratchDoc
+
+	// revisionLock is held while starting a new revision of a document so
+	// every writer shares the same scratch file.
+	revisionLock sync.Mutex
+
+	// server is the fuse server the filesystem is served with, which is
+	// used to drop entries from the kernel's cache.
+	server *fusefs.Server
 
 	fsRoot string
 	root   *root
 	fsdb   *db.DB
+	blobs  *blobStore
+
+	cascadeRemove  bool
+	tagDescendants bool
+
+	uid uint32
+	gid uint32
+
+	// mounted is when the filesystem was created, which is used as the
+	// time of directories.
+	mounted time.Time
+
+	purgeAge  time.Duration
+	stopPurge chan struct{}
+	purgeDone chan struct{}
+
+	// Documents are extracted for the search index in the background,
+	// in the order they were written.
+	extractors  map[string]Extractor
+	extractLock sync.Mutex
+	extractJobs []extractJob
+	extractWake chan struct{}
+	stopExtract context.CancelFunc
+	extractDone chan struct{}
 
 	clock glock.Clock
 }
@@ -46,7 +114,22 @@ type node struct {
 	name  string
 }
 
-func NewDocFS(fsRoot string) (*DocFS, error) {
+// InitDocFS creates a new, empty docfs root at fsRoot.
+func InitDocFS(fsRoot string) error {
+	err := os.MkdirAll(fsRoot, 0755)
+	if err != nil {
+		return err
+	}
+
+	fsdb, err := db.Open(path.Join(fsRoot, "docfs.db"))
+	if err != nil {
+		return err
+	}
+
+	return fsdb.Close()
+}
+
+func NewDocFS(fsRoot string, opts ...Option) (*DocFS, error) {
 	fInfo, err := os.Stat(fsRoot)
 	if err == os.ErrNotExist || fInfo == nil {
 		return nil, os.ErrNotExist
@@ -61,15 +144,66 @@ func NewDocFS(fsRoot string) (*DocFS, error) {
 	}
 
 	fs := &DocFS{
-		inodes: make(map[nodeType]map[uint64]uint64),
+		nodes:     make(map[uint64]fusefs.Node),
+		keyIDs:    make(map[string]uint64),
+		scratches: make(map[uint64]*scratchDoc),
 
 		fsRoot: fsRoot,
+		blobs:  newBlobStore(path.Join(fsRoot, "blobs")),
+
+		uid: uint32(os.Getuid()),
+		gid: uint32(os.Getgid()),
+
+		extractors:  defaultExtractors(),
+		extractWake: make(chan struct{}, 1),
 
 		clock: glock.NewRealClock(),
 	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	fs.mounted = fs.clock.Now()
 	fs.root = newRoot(fs)
 	fs.fsdb = fsdb
 
+	err = fs.migrateDocFiles()
+	if err != nil {
+		fsdb.Close()
+		return nil, err
+	}
+
+	// Documents that weren't extracted before docfs last stopped are
+	// queued before recovery queues the ones it files.
+	err = fs.queueUnindexed()
+	if err != nil {
+		fsdb.Close()
+		return nil, err
+	}
+
+	err = fs.recoverScratches()
+	if err != nil {
+		fsdb.Close()
+		return nil, err
+	}
+
+	if fs.purgeAge > 0 {
+		err = fs.purgeTrash()
+		if err != nil {
+			fsdb.Close()
+			return nil, err
+		}
+
+		fs.stopPurge = make(chan struct{})
+		fs.purgeDone = make(chan struct{})
+		go fs.purgeLoop()
+	}
+
+	// Documents queued above get extracted once the loop starts.
+	var extractCtx context.Context
+	extractCtx, fs.stopExtract = context.WithCancel(context.Background())
+	fs.extractDone = make(chan struct{})
+	go fs.extractLoop(extractCtx)
+
 	return fs, nil
 }
 
@@ -77,34 +211,265 @@ func (f *DocFS) Root() (fusefs.Node, error) {
 	return f.root, nil
 }
 
+// Serve serves the filesystem on a mounted fuse connection until it's
+// unmounted.
+func (f *DocFS) Serve(conn *fuse.Conn) error {
+	f.server = fusefs.New(conn, nil)
+	return f.server.Serve(f)
+}
+
+// invalidateEntry drops the kernel's cached entry for name in dir, along
+// with the cached contents of node if it isn't nil. The kernel holds the
+// directory's lock while it waits for a reply, so this is done in the
+// background to let the request being handled finish first.
+func (f *DocFS) invalidateEntry(dir fusefs.Node, name string, node fusefs.Node) {
+	if f.server == nil {
+		return
+	}
+
+	go func() {
+		err := f.server.InvalidateEntry(dir, name)
+		if err != nil && err != fuse.ErrNotCached {
+			debugf("could not invalidate entry %s: %s", name, err)
+		}
+
+		if node == nil {
+			return
+		}
+
+		err = f.server.InvalidateNodeData(node)
+		if err != nil && err != fuse.ErrNotCached {
+			debugf("could not invalidate node %s: %s", name, err)
+		}
+	}()
+}
+
+// cachedNode returns the node for inode if the kernel holds one.
+func (f *DocFS) cachedNode(inode uint64) fusefs.Node {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+
+	return f.nodes[inode]
+}
+
+// getInode returns the inode number for a node. Inodes are derived from the
+// node's type and ID so they stay the same across mounts, with the type kept
+// in the top byte and the ID in the remaining bits.
 func (f *DocFS) getInode(node nodeType, id uint64) uint64 {
-	fmt.Printf("docfs: %v\n", f)
-	f.inodeLock.Lock()
-	defer f.inodeLock.Unlock()
+	return (uint64(node)+1)<<inodeTypeShift | (id & inodeIDMask)
+}
+
+// getKeyID returns the ID for a node that's named by a key rather than by
+// a row in the database, such as a search query. Each key of a node type
+// gets its own ID the first time it's seen, and keeps it until the
+// filesystem is unmounted.
+func (f *DocFS) getKeyID(node nodeType, key string) uint64 {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
 
-	typeMap, ok := f.inodes[node]
+	mapKey := fmt.Sprintf("%d:%s", node, key)
+	id, ok := f.keyIDs[mapKey]
 	if !ok {
-		typeMap = make(map[uint64]uint64)
-		f.inodes[node] = typeMap
+		id = uint64(len(f.keyIDs)) + 1
+		f.keyIDs[mapKey] = id
 	}
 
-	inode, ok := typeMap[id]
+	return id
+}
+
+// getNode returns the node for inode, calling newNode to create it if the
+// kernel doesn't already hold one. Returning the same node for repeated
+// lookups lets fuse reuse the kernel's node ID instead of allocating a new
+// one every time.
+//
+// Nodes stay in the table until the kernel forgets them, so every node
+// returned from here must implement fusefs.NodeForgetter and call forgetNode.
+// The table doesn't count lookups itself: fuse counts the kernel's lookups
+// of each node, subtracts the count in every forget request and only calls
+// Forget once it drops to zero.
+func (f *DocFS) getNode(inode uint64, newNode func() fusefs.Node) fusefs.Node {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+
+	n, ok := f.nodes[inode]
 	if !ok {
-		f.inodeCount++
-		inode = f.inodeCount
-		typeMap[id] = inode
+		n = newNode()
+		f.nodes[inode] = n
+	}
+
+	return n
+}
+
+// forgetNode removes n from the node table once fuse has seen the kernel
+// release every lookup of it. The entry is left alone if it has already
+// been replaced by a newer node for the same inode.
+func (f *DocFS) forgetNode(inode uint64, n fusefs.Node) {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+
+	if cur, ok := f.nodes[inode]; ok && cur == n {
+		debugf("forgetting inode %d", inode)
+		delete(f.nodes, inode)
+	}
+}
+
+// idName names an entry in a directory that can hold entries with the same
+// name, such as lost+found, by prefixing the name with the entry's ID.
+func idName(id uint64, name string) string {
+	return fmt.Sprintf("%d-%s", id, name)
+}
+
+// parseIDName returns the ID from a name created by idName.
+func parseIDName(name string) (uint64, bool) {
+	idx := strings.Index(name, "-")
+	if idx < 0 {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(name[:idx], 10, 0)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (f *DocFS) addScratch(s *scratchDoc) {
+	f.scratchLock.Lock()
+	defer f.scratchLock.Unlock()
+
+	f.scratches[s.id] = s
+}
+
+func (f *DocFS) removeScratch(s *scratchDoc) {
+	f.scratchLock.Lock()
+	defer f.scratchLock.Unlock()
+
+	delete(f.scratches, s.id)
+}
+
+// getScratches returns the new scratch documents being written for a day.
+// Scratch files for new revisions of existing documents aren't included.
+func (f *DocFS) getScratches(year uint64, month uint64, day uint64) []*scratchDoc {
+	f.scratchLock.Lock()
+	defer f.scratchLock.Unlock()
+
+	var scratches []*scratchDoc
+	for _, s := range f.scratches {
+		if s.docID == 0 && s.year == year && s.month == month && s.day == day {
+			scratches = append(scratches, s)
+		}
+	}
+
+	return scratches
+}
+
+// getScratch returns the scratch document being written for a day with the
+// given name, or nil if there isn't one.
+func (f *DocFS) getScratch(year uint64, month uint64, day uint64, name string) *scratchDoc {
+	for _, s := range f.getScratches(year, month, day) {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// getTagScratches returns the new documents being written in a tag's
+// directory.
+func (f *DocFS) getTagScratches(tagID uint64) []*scratchDoc {
+	f.scratchLock.Lock()
+	defer f.scratchLock.Unlock()
+
+	var scratches []*scratchDoc
+	for _, s := range f.scratches {
+		if s.docID == 0 && s.tagID == tagID {
+			scratches = append(scratches, s)
+		}
 	}
 
-	fmt.Printf("Nodes: %+v\n", f.inodes)
+	return scratches
+}
 
-	return inode
+// getTagScratch returns the new document being written in a tag's directory
+// with the given name, or nil if there isn't one.
+func (f *DocFS) getTagScratch(tagID uint64, name string) *scratchDoc {
+	for _, s := range f.getTagScratches(tagID) {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// getDocScratch returns the scratch document a new revision of a document is
+// being written to, or nil if there isn't one.
+func (f *DocFS) getDocScratch(docID uint64) *scratchDoc {
+	f.scratchLock.Lock()
+	defer f.scratchLock.Unlock()
+
+	for _, s := range f.scratches {
+		if s.docID == docID {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (f *DocFS) scratchPath(id uint64) string {
+	return path.Join(f.fsRoot, "scratch", fmt.Sprintf("%d", id))
+}
+
+// migrateDocFiles moves documents stored by uuid, before the blob store was
+// added, into the blob store.
+func (f *DocFS) migrateDocFiles() error {
+	docsRoot := path.Join(f.fsRoot, "docs")
+	if _, err := os.Stat(docsRoot); os.IsNotExist(err) {
+		return nil
+	}
+
+	docs, err := f.fsdb.GetAllDocs()
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		docPath := path.Join(docsRoot, doc.UUID)
+		if _, err := os.Stat(docPath); os.IsNotExist(err) {
+			continue
+		}
+
+		stored, err := f.blobs.put(docPath, doc.Checksum)
+		if err != nil {
+			return err
+		}
+
+		if !stored {
+			err = os.Remove(docPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Anything left over doesn't belong to a document, so leave it for
+	// someone to look at rather than failing to start.
+	err = os.Remove(docsRoot)
+	if err != nil {
+		debugf("could not remove old docs directory: %s", err)
+	}
+
+	return nil
 }
 
 func (f *DocFS) openScratch(id uint64) (*os.File, error) {
-	scratchRoot := path.Join(f.fsRoot, "scratch")
-	docPath := path.Join(scratchRoot, fmt.Sprintf("%d", id))
-	fmt.Printf("scratch path: %s\n", docPath)
+	docPath := f.scratchPath(id)
+	debugf("scratch path: %s", docPath)
 
+	scratchRoot := path.Dir(docPath)
 	if _, err := os.Stat(scratchRoot); os.IsNotExist(err) {
 		err = os.MkdirAll(scratchRoot, 0755)
 		if err != nil {
@@ -121,5 +486,13 @@ func (f *DocFS) openScratch(id uint64) (*os.File, error) {
 }
 
 func (f *DocFS) Close() error {
+	f.stopExtract()
+	<-f.extractDone
+
+	if f.stopPurge != nil {
+		close(f.stopPurge)
+		<-f.purgeDone
+	}
+
 	return f.fsdb.Close()
 }
@@ -0,0 +1,274 @@
+package dfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+func (f *DocFS) lostPath(id uint64) string {
+	return path.Join(f.fsRoot, "lost+found", fmt.Sprintf("%d", id))
+}
+
+// recoverScratches reconciles the scratch entries with the scratch files
+// left behind if docfs stopped while documents were being written. Scratch
+// files that were completely written are promoted, partially written ones
+// are moved to lost+found and entries without a file are removed.
+func (f *DocFS) recoverScratches() error {
+	scratches, err := f.fsdb.GetScratches("")
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, s := range scratches {
+		known[fmt.Sprintf("%d", s.ID)] = true
+
+		if s.State == db.ScratchLost {
+			if _, err := os.Stat(f.lostPath(s.ID)); os.IsNotExist(err) {
+				debugf("removing lost scratch %d without a file", s.ID)
+				err = f.fsdb.RemoveScratch(s.ID)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		scratchPath := f.scratchPath(s.ID)
+		if _, err := os.Stat(scratchPath); os.IsNotExist(err) {
+			debugf("removing scratch %d without a file", s.ID)
+			err = f.fsdb.RemoveScratch(s.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if s.State == db.ScratchClosed {
+			debugf("promoting closed scratch %d", s.ID)
+			err = f.recoverClosedScratch(s)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		debugf("moving partial scratch %d to lost+found", s.ID)
+		err = f.moveToLost(s.ID, scratchPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Files in the scratch directory without an entry can't be promoted
+	// since nothing is known about them, so keep them in lost+found under
+	// a new entry.
+	files, err := ioutil.ReadDir(path.Dir(f.scratchPath(0)))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || known[file.Name()] {
+			continue
+		}
+
+		now := f.clock.Now()
+		id, err := f.fsdb.CreateScratch(
+			file.Name(), now.Year(), int(now.Month()), now.Day(), now, 0,
+		)
+		if err != nil {
+			return err
+		}
+
+		debugf("moving unknown scratch file %s to lost+found", file.Name())
+		err = f.moveToLost(id, path.Join(path.Dir(f.scratchPath(0)), file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *DocFS) recoverClosedScratch(s *db.Scratch) error {
+	file, err := os.Open(f.scratchPath(s.ID))
+	if err != nil {
+		return err
+	}
+
+	hashStr, err := hashFile(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.DocID != 0 {
+		return addScratchRevision(f, s.ID, s.DocID, hashStr)
+	}
+
+	// The day could have been removed while docfs wasn't running, promoting
+	// the scratch file adds it back.
+	return promoteScratchDoc(f, s.ID, hashStr, s.TagID)
+}
+
+func (f *DocFS) moveToLost(id uint64, srcPath string) error {
+	lostPath := f.lostPath(id)
+	err := os.MkdirAll(path.Dir(lostPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(srcPath, lostPath)
+	if err != nil {
+		return err
+	}
+
+	return f.fsdb.SetScratchState(id, db.ScratchLost)
+}
+
+// fsLostFound lists the partially written scratch files found on startup so
+// they can be copied out or removed.
+type fsLostFound struct {
+	node
+
+	fs *DocFS
+}
+
+func newFsLostFound(fs *DocFS) *fsLostFound {
+	l := &fsLostFound{
+		fs: fs,
+	}
+	l.inode = fs.getInode(nLostFound, 0)
+	l.name = "lost+found"
+
+	return l
+}
+
+func lostName(s *db.Scratch) string {
+	return idName(s.ID, s.Name)
+}
+
+func (l *fsLostFound) Attr(ctx context.Context, attr *fuse.Attr) error {
+	l.fs.dirAttr(attr, l.inode, 0755, 0)
+	return nil
+}
+
+func (l *fsLostFound) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	scratches, err := l.fs.fsdb.GetScratches(db.ScratchLost)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, s := range scratches {
+		children = append(children, fuse.Dirent{
+			Name:  lostName(s),
+			Inode: l.fs.getInode(nLost, s.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+// getLost returns the lost scratch entry for a name in the lost+found
+// directory.
+func (l *fsLostFound) getLost(name string) (*db.Scratch, error) {
+	id, ok := parseIDName(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	s, err := l.fs.fsdb.GetScratch(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.State != db.ScratchLost || lostName(s) != name {
+		return nil, fuse.ENOENT
+	}
+
+	return s, nil
+}
+
+func (l *fsLostFound) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	s, err := l.getLost(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsLost(l.fs, s.ID, name), nil
+}
+
+func (l *fsLostFound) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return fuse.ENOENT
+	}
+
+	s, err := l.getLost(req.Name)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	err = os.Remove(l.fs.lostPath(s.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return fuseError(err)
+	}
+
+	return fuseError(l.fs.fsdb.RemoveScratch(s.ID))
+}
+
+// fsLost is a read only view of a file in lost+found.
+type fsLost struct {
+	node
+
+	fs *DocFS
+
+	id uint64
+}
+
+func newFsLost(fs *DocFS, id uint64, name string) *fsLost {
+	l := &fsLost{
+		fs: fs,
+		id: id,
+	}
+	l.inode = fs.getInode(nLost, id)
+	l.name = name
+
+	return l
+}
+
+func (l *fsLost) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fInfo, err := os.Stat(l.fs.lostPath(l.id))
+	if err != nil {
+		return fuseError(err)
+	}
+
+	l.fs.fileAttr(attr, l.inode, 0444, fInfo.Size(), fInfo.ModTime(), fInfo.ModTime())
+	return nil
+}
+
+func (l *fsLost) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	file, err := os.Open(l.fs.lostPath(l.id))
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return &fsDocHandle{
+		file: file,
+	}, nil
+}
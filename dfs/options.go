@@ -0,0 +1,61 @@
+package dfs
+
+import "time"
+
+// Option configures optional behavior of a DocFS.
+type Option func(*DocFS)
+
+// CascadeRemove makes removing a year, month or day directory also remove
+// the documents filed under it. Without it, removing a date directory that
+// still has documents fails with ENOTEMPTY.
+func CascadeRemove() Option {
+	return func(f *DocFS) {
+		f.cascadeRemove = true
+	}
+}
+
+// Owner makes every file and directory owned by the given user and group
+// instead of the user running docfs.
+func Owner(uid, gid uint32) Option {
+	return func(f *DocFS) {
+		f.uid = uid
+		f.gid = gid
+	}
+}
+
+// PurgeAge makes documents and tags that have been in the trash for longer
+// than age get removed permanently. Without it the trash is only emptied by
+// removing entries from it.
+func PurgeAge(age time.Duration) Option {
+	return func(f *DocFS) {
+		f.purgeAge = age
+	}
+}
+
+// TagDescendants makes tag directories also list the documents of the tags
+// nested under them, so finance lists everything in finance/taxes too.
+func TagDescendants() Option {
+	return func(f *DocFS) {
+		f.tagDescendants = true
+	}
+}
+
+// ExtractWith makes documents of a MIME type be extracted for the search
+// index with e instead of a built in extractor. The MIME type can also be
+// like image/* to extract every type of image that doesn't have an
+// extractor of its own.
+func ExtractWith(mediaType string, e Extractor) Option {
+	return func(f *DocFS) {
+		f.extractors[mediaType] = e
+	}
+}
+
+// ExtractCommand makes documents of a MIME type be extracted by running a
+// command with the document as its stdin and indexing what it writes to
+// stdout, such as pdftotext or an OCR program.
+func ExtractCommand(mediaType string, name string, args ...string) Option {
+	return ExtractWith(mediaType, &commandExtractor{
+		name: name,
+		args: args,
+	})
+}
@@ -0,0 +1,207 @@
+package dfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+// revisionsSuffix is added to a document's name to look up the directory
+// holding its revisions. The directories aren't listed since they'd double
+// the size of every listing.
+const revisionsSuffix = "@revisions"
+
+// lookupRevisions returns the revisions directory for name if it refers to
+// one, using getDoc to find the document in the directory being looked in.
+func lookupRevisions(fs *DocFS, name string, getDoc func(name string) (*db.Doc, error)) (fusefs.Node, bool, error) {
+	if !strings.HasSuffix(name, revisionsSuffix) {
+		return nil, false, nil
+	}
+
+	doc, err := getDoc(strings.TrimSuffix(name, revisionsSuffix))
+	if err != nil {
+		return nil, true, err
+	}
+
+	return newFsRevisions(fs, doc.ID, name), true, nil
+}
+
+// fsRevisions lists every revision of a document as r1, r2 and so on.
+// Renaming a revision over the document reverts the document to it.
+type fsRevisions struct {
+	node
+
+	fs *DocFS
+
+	docID uint64
+}
+
+func newFsRevisions(fs *DocFS, docID uint64, name string) *fsRevisions {
+	r := &fsRevisions{
+		fs:    fs,
+		docID: docID,
+	}
+	r.inode = fs.getInode(nRevisions, docID)
+	r.name = name
+
+	return r
+}
+
+func revisionName(rev uint64) string {
+	return fmt.Sprintf("r%d", rev)
+}
+
+func parseRevisionName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "r") {
+		return 0, false
+	}
+
+	rev, err := strconv.ParseUint(name[1:], 10, 0)
+	if err != nil {
+		return 0, false
+	}
+
+	return rev, true
+}
+
+func (r *fsRevisions) Attr(ctx context.Context, attr *fuse.Attr) error {
+	r.fs.dirAttr(attr, r.inode, 0555, 0)
+	return nil
+}
+
+func (r *fsRevisions) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	revs, err := r.fs.fsdb.GetRevisions(r.docID)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, rev := range revs {
+		children = append(children, fuse.Dirent{
+			Name:  revisionName(rev.Rev),
+			Inode: r.fs.getInode(nRevision, rev.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+func (r *fsRevisions) getRevision(name string) (*db.Revision, error) {
+	rev, ok := parseRevisionName(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return r.fs.fsdb.GetRevision(r.docID, rev)
+}
+
+func (r *fsRevisions) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	rev, err := r.getRevision(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsRevision(r.fs, rev, name), nil
+}
+
+// Rename reverts the document to a revision when the revision is renamed
+// over the document in a directory it's listed in. The revision stays in
+// the history and its contents are added as a new revision. The kernel
+// moves the revision's entry over the document's once the rename succeeds,
+// so the entry is dropped again to make the next lookup find the document.
+func (r *fsRevisions) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	rev, err := r.getRevision(req.OldName)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	doc, err := r.fs.fsdb.GetDoc(r.docID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	var target *db.Doc
+	switch dir := newDir.(type) {
+	case *fsDay:
+		target, err = r.fs.fsdb.GetDocByName(dir.Year, dir.Month, dir.Day, req.NewName)
+	case *fsTag:
+		target, err = dir.getDoc(req.NewName)
+	default:
+		return fuse.EPERM
+	}
+	if err == db.ErrNotExists || (err == nil && target.ID != doc.ID) {
+		return fuse.EPERM
+	} else if err != nil {
+		return fuseError(err)
+	}
+
+	if rev.Checksum == doc.Checksum {
+		r.fs.invalidateEntry(newDir, req.NewName, nil)
+		return nil
+	}
+
+	// Hold the blob lock so the blob can't be removed before the new
+	// revision refers to it.
+	r.fs.blobs.Lock()
+	defer r.fs.blobs.Unlock()
+
+	_, err = r.fs.fsdb.AddRevision(doc.ID, rev.Checksum, r.fs.clock.Now())
+	if err != nil {
+		return fuseError(err)
+	}
+
+	r.fs.queueExtract(doc.ID, rev.Checksum)
+	r.fs.invalidateEntry(newDir, req.NewName, r.fs.cachedNode(r.fs.getInode(nDoc, doc.ID)))
+	return nil
+}
+
+// fsRevision is a read only view of a single revision of a document.
+type fsRevision struct {
+	node
+
+	fs *DocFS
+
+	rev *db.Revision
+}
+
+func newFsRevision(fs *DocFS, rev *db.Revision, name string) *fsRevision {
+	r := &fsRevision{
+		fs:  fs,
+		rev: rev,
+	}
+	r.inode = fs.getInode(nRevision, rev.ID)
+	r.name = name
+
+	return r
+}
+
+func (r *fsRevision) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fInfo, err := r.fs.blobs.stat(r.rev.Checksum)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	r.fs.fileAttr(attr, r.inode, 0444, fInfo.Size(), r.rev.Created, r.rev.Created)
+	return nil
+}
+
+func (r *fsRevision) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	file, err := r.fs.blobs.open(r.rev.Checksum)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return &fsDocHandle{
+		file: file,
+	}, nil
+}
@@ -1,8 +1,6 @@
 package dfs
 
 import (
-	"os"
-
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"golang.org/x/net/context"
@@ -11,9 +9,12 @@ import (
 type root struct {
 	node
 
-	fs   *DocFS
-	tags *fsTags
-	docs *fsDocs
+	fs     *DocFS
+	tags   *fsTags
+	docs   *fsDocs
+	lost   *fsLostFound
+	trash  *fsTrash
+	search *fsSearch
 }
 
 func newRoot(fs *DocFS) *root {
@@ -25,13 +26,15 @@ func newRoot(fs *DocFS) *root {
 
 	r.tags = newFsTags(fs)
 	r.docs = newFsDocs(fs)
+	r.lost = newFsLostFound(fs)
+	r.trash = newFsTrash(fs)
+	r.search = newFsSearch(fs)
 
 	return r
 }
 
 func (r *root) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = r.inode
-	attr.Mode = os.ModeDir | 0755
+	r.fs.dirAttr(attr, r.inode, 0755, 5)
 	return nil
 }
 
@@ -45,6 +48,18 @@ func (r *root) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		Inode: r.docs.inode,
 		Name:  "documents",
 	})
+	children = append(children, fuse.Dirent{
+		Inode: r.lost.inode,
+		Name:  "lost+found",
+	})
+	children = append(children, fuse.Dirent{
+		Inode: r.trash.inode,
+		Name:  "trash",
+	})
+	children = append(children, fuse.Dirent{
+		Inode: r.search.inode,
+		Name:  "search",
+	})
 	return children, nil
 }
 
@@ -53,6 +68,12 @@ func (r *root) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
 		return r.tags, nil
 	} else if name == "documents" {
 		return r.docs, nil
+	} else if name == "lost+found" {
+		return r.lost, nil
+	} else if name == "trash" {
+		return r.trash, nil
+	} else if name == "search" {
+		return r.search, nil
 	}
 	return nil, fuse.ENOENT
 }
@@ -1,94 +1,420 @@
 package dfs
 
 import (
-	"fmt"
-
+	"io"
 	"os"
-
-	"hash"
+	"sync"
+	"time"
 
 	"crypto/sha256"
 
 	"encoding/hex"
 
-	"bufio"
-
 	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
 	"golang.org/x/net/context"
 )
 
+// scratchDoc is a document that's still being written. Every open handle
+// shares the same scratch file, and the document is promoted once the last
+// handle is released.
 type scratchDoc struct {
 	fs *DocFS
 
 	id    uint64
 	inode uint64
 
-	hasher hash.Hash
+	name  string
+	year  uint64
+	month uint64
+	day   uint64
+
+	// tagID is the tag applied to the document once it's promoted, or 0
+	// if the scratch file wasn't created in a tag directory.
+	tagID uint64
+
+	// docID is the document the scratch file is a new revision of, or 0
+	// if the scratch file is a new document.
+	docID uint64
 
-	file    *os.File
-	fileBuf *bufio.Writer
+	created time.Time
+
+	lock     sync.RWMutex
+	handles  int
+	file     *os.File
+	size     int64
+	modified time.Time
 }
 
-func newScratchDoc(fs *DocFS, id uint64) *scratchDoc {
+func newScratchDoc(fs *DocFS, id uint64, name string, year, month, day uint64) *scratchDoc {
 	return &scratchDoc{
 		fs: fs,
 
 		id:    id,
 		inode: fs.getInode(nScratch, id),
 
-		hasher: sha256.New(),
+		name:  name,
+		year:  year,
+		month: month,
+		day:   day,
 	}
 }
 
-func (s *scratchDoc) Open() error {
+// createScratchDoc creates a new scratch document and opens its file. The
+// scratch document is tracked by the DocFS until it's promoted.
+func createScratchDoc(fs *DocFS, name string, year, month, day uint64, tagID uint64) (*scratchDoc, error) {
+	curTime := fs.clock.Now()
+
+	sID, err := fs.fsdb.CreateScratch(name, int(year), int(month), int(day), curTime, tagID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := newScratchDoc(fs, sID, name, year, month, day)
+	doc.tagID = tagID
+	doc.created = curTime
+	err = doc.openFile()
+	if err != nil {
+		removeScratchDoc(fs, sID)
+		return nil, err
+	}
+
+	fs.addScratch(doc)
+
+	return doc, nil
+}
+
+func (s *scratchDoc) openFile() error {
 	file, err := s.fs.openScratch(s.id)
 	if err != nil {
 		return err
 	}
 
 	s.file = file
-	s.fileBuf = bufio.NewWriter(s.file)
 
 	return nil
 }
 
-func (s *scratchDoc) Close() error {
-	hash := s.hasher.Sum(nil)
-	hashStr := hex.EncodeToString(hash)
-	fmt.Printf("Closing scratch %d with hash %s\n", s.id, hashStr)
+// close closes the scratch file and promotes it to a document. It must only
+// be called with the write lock held.
+func (s *scratchDoc) close() error {
+	s.fs.removeScratch(s)
+
+	fInfo, err := s.file.Stat()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	s.size = fInfo.Size()
+	s.modified = fInfo.ModTime()
+
+	// Writes can land anywhere in the file so the hash can only be
+	// generated once the contents are final.
+	hashStr, err := hashFile(s.file)
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+
+	err = s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	// Once the scratch file is marked closed its contents are final, so
+	// it can be promoted on startup if docfs stops before it's finished.
+	err = s.fs.fsdb.SetScratchState(s.id, db.ScratchClosed)
+	if err != nil {
+		return err
+	}
+
+	if s.docID != 0 {
+		return addScratchRevision(s.fs, s.id, s.docID, hashStr)
+	}
 
-	return s.file.Close()
+	return promoteScratchDoc(s.fs, s.id, hashStr, s.tagID)
 }
 
-func (s *scratchDoc) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = s.inode
-	attr.Mode = 0755
+// promoteScratchDoc turns a closed scratch file into a document, tagging it
+// with tagID if it isn't 0.
+func promoteScratchDoc(fs *DocFS, id uint64, checksum string, tagID uint64) error {
+	if tagID != 0 {
+		// A file copied into a tag directory that we already have is
+		// just a request to tag the existing document.
+		existing, err := fs.fsdb.GetDocByChecksum(checksum)
+		if err == nil {
+			err = fs.fsdb.TagDoc(tagID, existing.ID)
+			if err != nil {
+				return err
+			}
+
+			return removeScratchDoc(fs, id)
+		} else if err != db.ErrNotExists {
+			return err
+		}
+	}
+
+	docID, err := moveScratchDoc(fs, id, checksum)
+	if err != nil {
+		return err
+	}
+	fs.queueExtract(docID, checksum)
+
+	if tagID != 0 {
+		return fs.fsdb.TagDoc(tagID, docID)
+	}
+
 	return nil
 }
 
-func (s *scratchDoc) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	writeN, err := s.fileBuf.Write(req.Data)
+// openDocScratch returns a handle to a scratch file for writing a new
+// revision of an existing document. Every writer of a document shares the
+// same scratch file, which starts out with the document's current contents
+// unless truncate is set.
+func openDocScratch(fs *DocFS, docID uint64, truncate bool) (*scratchDoc, *scratchHandle, error) {
+	fs.revisionLock.Lock()
+	defer fs.revisionLock.Unlock()
+
+	if s := fs.getDocScratch(docID); s != nil {
+		handle, err := s.newHandle()
+		if err == nil {
+			if truncate {
+				err = s.truncate(0)
+				if err != nil {
+					s.release()
+					return nil, nil, err
+				}
+			}
+			return s, handle, nil
+		} else if err != fuse.ESTALE {
+			return nil, nil, err
+		}
+
+		// The last writer released the scratch file while we were
+		// waiting for it so start a new one.
+	}
+
+	doc, err := fs.fsdb.GetDoc(docID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	curTime := fs.clock.Now()
+	sID, err := fs.fsdb.CreateDocScratch(docID, curTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := newScratchDoc(fs, sID, doc.Filename, doc.Year, doc.Month, doc.Day)
+	s.docID = docID
+	s.created = curTime
+	err = s.openFile()
+	if err != nil {
+		removeScratchDoc(fs, sID)
+		return nil, nil, err
+	}
+
+	if !truncate {
+		err = copyBlob(fs, doc.Checksum, s.file)
+		if err != nil {
+			s.file.Close()
+			removeScratchDoc(fs, sID)
+			return nil, nil, err
+		}
+	}
+
+	fs.addScratch(s)
+
+	handle, err := s.newHandle()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, handle, nil
+}
+
+// copyBlob copies the contents of a blob into the start of dst.
+func copyBlob(fs *DocFS, checksum string, dst *os.File) error {
+	src, err := fs.blobs.open(checksum)
 	if err != nil {
 		return err
 	}
+	defer src.Close()
 
-	hashN, err := s.hasher.Write(req.Data)
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// addScratchRevision adds a closed scratch file as a new revision of its
+// document. Nothing is added if the contents didn't change.
+func addScratchRevision(fs *DocFS, id uint64, docID uint64, checksum string) error {
+	doc, err := fs.fsdb.GetDoc(docID)
 	if err != nil {
 		return err
 	}
 
-	if writeN != hashN {
-		return ErrHashFailure
+	if doc.Checksum == checksum {
+		return removeScratchDoc(fs, id)
 	}
 
-	resp.Size = writeN
+	err = storeScratch(fs, id, checksum, func() error {
+		_, err := fs.fsdb.PromoteRevisionScratch(id, checksum)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.queueExtract(docID, checksum)
 	return nil
 }
 
-func (s *scratchDoc) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	return s.fileBuf.Flush()
+// newHandle returns a new handle to the scratch file, or ESTALE if the
+// scratch file has already been promoted.
+func (s *scratchDoc) newHandle() (*scratchHandle, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil, fuse.ESTALE
+	}
+
+	s.handles++
+	return &scratchHandle{
+		doc: s,
+	}, nil
 }
 
-func (s *scratchDoc) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	return s.Close()
+func (s *scratchDoc) release() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handles--
+	if s.handles > 0 {
+		return nil
+	}
+
+	return s.close()
+}
+
+func (s *scratchDoc) Attr(ctx context.Context, attr *fuse.Attr) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	size := s.size
+	modified := s.modified
+	if s.file != nil {
+		fInfo, err := s.file.Stat()
+		if err != nil {
+			return fuseError(err)
+		}
+		size = fInfo.Size()
+		modified = fInfo.ModTime()
+	}
+
+	s.fs.fileAttr(attr, s.inode, 0644, size, modified, s.created)
+	return nil
+}
+
+func (s *scratchDoc) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	return s.newHandle()
+}
+
+func (s *scratchDoc) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		err := s.truncate(int64(req.Size))
+		if err != nil {
+			return fuseError(err)
+		}
+	}
+
+	return s.Attr(ctx, &resp.Attr)
+}
+
+func (s *scratchDoc) truncate(size int64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.file == nil {
+		return fuse.ESTALE
+	}
+
+	return s.file.Truncate(size)
+}
+
+func (s *scratchDoc) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	return fuseError(s.file.Sync())
+}
+
+// scratchHandle is an open handle to a scratch document. Reads and writes
+// go straight to the shared scratch file so every handle sees the same
+// contents.
+type scratchHandle struct {
+	doc *scratchDoc
+}
+
+func (h *scratchHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.doc.lock.RLock()
+	defer h.doc.lock.RUnlock()
+
+	buf := make([]byte, req.Size)
+	n, err := h.doc.file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return fuseError(err)
+	}
+
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *scratchHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.doc.lock.RLock()
+	defer h.doc.lock.RUnlock()
+
+	n, err := h.doc.file.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	resp.Size = n
+	return nil
+}
+
+func (h *scratchHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fuseError(h.doc.release())
+}
+
+// hashFile returns the hex encoded SHA-256 of the entire contents of file.
+func hashFile(file *os.File) (string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// removeScratchDoc discards a scratch file and its scratch entry.
+func removeScratchDoc(fs *DocFS, id uint64) error {
+	err := os.Remove(fs.scratchPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return fs.fsdb.RemoveScratch(id)
 }
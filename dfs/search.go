@@ -0,0 +1,106 @@
+package dfs
+
+import (
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+// fsSearch holds a directory for every search query looked up in it. The
+// queries use the FTS5 query syntax and aren't listed.
+type fsSearch struct {
+	node
+
+	fs *DocFS
+}
+
+func newFsSearch(fs *DocFS) *fsSearch {
+	s := &fsSearch{
+		fs: fs,
+	}
+	s.inode = fs.getInode(nSearch, 0)
+	s.name = "search"
+
+	return s
+}
+
+func (s *fsSearch) Attr(ctx context.Context, attr *fuse.Attr) error {
+	s.fs.dirAttr(attr, s.inode, 0555, 0)
+	return nil
+}
+
+func (s *fsSearch) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return nil, nil
+}
+
+func (s *fsSearch) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	// Run the query up front so a query that can't be parsed, or a docfs
+	// built without search, fails the lookup instead of the listing.
+	_, err := s.fs.fsdb.SearchDocs(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsSearchResults(s.fs, name), nil
+}
+
+// fsSearchResults lists the documents matching a search query, ranked by
+// how well they match.
+type fsSearchResults struct {
+	node
+
+	fs *DocFS
+
+	query string
+}
+
+func newFsSearchResults(fs *DocFS, query string) *fsSearchResults {
+	s := &fsSearchResults{
+		fs:    fs,
+		query: query,
+	}
+	s.inode = fs.getInode(nSearchResults, fs.getKeyID(nSearchResults, query))
+	s.name = query
+
+	return s
+}
+
+func (s *fsSearchResults) Attr(ctx context.Context, attr *fuse.Attr) error {
+	s.fs.dirAttr(attr, s.inode, 0555, 0)
+	return nil
+}
+
+func (s *fsSearchResults) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	docs, err := s.fs.fsdb.SearchDocs(s.query)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  doc.Filename,
+			Inode: s.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+func (s *fsSearchResults) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	getDoc := func(name string) (*db.Doc, error) {
+		return s.fs.fsdb.SearchDocByName(s.query, name)
+	}
+	if revs, ok, err := lookupRevisions(s.fs, name, getDoc); ok {
+		return revs, fuseError(err)
+	}
+
+	doc, err := getDoc(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsDoc(s.fs, doc.ID, doc.Filename), nil
+}
@@ -0,0 +1,140 @@
+package dfs
+
+import (
+	"fmt"
+	"strings"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+// Looking up +name in a tag directory narrows it to documents that also
+// have the tag name, and -name narrows it to documents that don't. Filters
+// can be combined, as in tags/taxes/+receipts/-draft. A nested tag can be
+// named by its path with filterSeparator in place of the tag path separator,
+// as in +finance:2017, since the path separator can't be used in a name.
+const (
+	filterInclude   = "+"
+	filterExclude   = "-"
+	filterSeparator = ":"
+)
+
+// lookupTagFilter returns the directory for adding the filter in name to
+// the include and exclude filters, or false if name isn't a filter. Names
+// that look like filters but don't name a tag aren't filters so documents
+// with those names can still be looked up. Nested tags are found by their
+// own name, or by their path if the name has a filterSeparator in it.
+func lookupTagFilter(fs *DocFS, include []uint64, exclude []uint64, name string) (fusefs.Node, bool, error) {
+	var prefix string
+	if strings.HasPrefix(name, filterInclude) {
+		prefix = filterInclude
+	} else if strings.HasPrefix(name, filterExclude) {
+		prefix = filterExclude
+	} else {
+		return nil, false, nil
+	}
+
+	tagName := strings.TrimPrefix(name, prefix)
+	var tag *db.Tag
+	var err error
+	if strings.Contains(tagName, filterSeparator) {
+		tag, err = fs.fsdb.GetTagByPath(
+			strings.Replace(tagName, filterSeparator, db.TagPathSeparator, -1),
+		)
+	} else {
+		tag, err = fs.fsdb.FindTag(tagName)
+	}
+	if err == db.ErrNotExists {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, true, err
+	}
+
+	// Copy the filters so sibling filter directories don't share them.
+	newInclude := append([]uint64{}, include...)
+	newExclude := append([]uint64{}, exclude...)
+	if prefix == filterInclude && !hasTagID(include, tag.ID) {
+		newInclude = append(newInclude, tag.ID)
+	} else if prefix == filterExclude && !hasTagID(exclude, tag.ID) {
+		newExclude = append(newExclude, tag.ID)
+	}
+
+	return newFsTagFilter(fs, newInclude, newExclude, name), true, nil
+}
+
+func hasTagID(ids []uint64, id uint64) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// fsTagFilter lists the documents that have every tag in include and none
+// of the tags in exclude.
+type fsTagFilter struct {
+	node
+
+	fs *DocFS
+
+	include []uint64
+	exclude []uint64
+}
+
+func newFsTagFilter(fs *DocFS, include []uint64, exclude []uint64, name string) *fsTagFilter {
+	t := &fsTagFilter{
+		fs:      fs,
+		include: include,
+		exclude: exclude,
+	}
+	t.inode = fs.getInode(nTagFilter, fs.getKeyID(nTagFilter, fmt.Sprintf("%v-%v", include, exclude)))
+	t.name = name
+
+	return t
+}
+
+func (t *fsTagFilter) Attr(ctx context.Context, attr *fuse.Attr) error {
+	t.fs.dirAttr(attr, t.inode, 0555, 0)
+	return nil
+}
+
+func (t *fsTagFilter) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	docs, err := t.fs.fsdb.GetFilteredDocs(t.include, t.exclude)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  doc.Filename,
+			Inode: t.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+func (t *fsTagFilter) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	if filter, ok, err := lookupTagFilter(t.fs, t.include, t.exclude, name); ok {
+		return filter, fuseError(err)
+	}
+
+	getDoc := func(name string) (*db.Doc, error) {
+		return t.fs.fsdb.GetFilteredDocByName(t.include, t.exclude, name)
+	}
+	if revs, ok, err := lookupRevisions(t.fs, name, getDoc); ok {
+		return revs, fuseError(err)
+	}
+
+	doc, err := getDoc(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsDoc(t.fs, doc.ID, doc.Filename), nil
+}
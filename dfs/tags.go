@@ -1,10 +1,9 @@
 package dfs
 
 import (
-	"os"
-
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
 	"golang.org/x/net/context"
 )
 
@@ -25,61 +24,115 @@ func newFsTags(fs *DocFS) *fsTags {
 }
 
 func (t *fsTags) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = t.inode
-	attr.Mode = os.ModeDir | 0755
+	tags, err := t.fs.fsdb.GetChildTags(0)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	t.fs.dirAttr(attr, t.inode, 0755, len(tags))
 	return nil
 }
 
 func (t *fsTags) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	tags, err := t.fs.fsdb.GetTags()
+	return readTagDirs(t.fs, 0)
+}
+
+func (t *fsTags) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	return mkdirTag(t.fs, 0, req.Name)
+}
+
+func (t *fsTags) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	foundTag, err := t.fs.fsdb.GetTag(0, name)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
+	}
+
+	return newFsTag(t.fs, foundTag.ID, foundTag.Name), nil
+}
+
+func (t *fsTags) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !req.Dir {
+		return errIsDir
+	}
+
+	err := t.fs.fsdb.RemoveTag(0, req.Name, t.fs.clock.Now())
+	if err != nil {
+		return fuseError(err)
+	}
+
+	return nil
+}
+
+func (t *fsTags) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	return renameTag(t.fs, 0, req, newDir)
+}
+
+// readTagDirs lists the tags directly under a tag, or the top level tags if
+// parentID is 0.
+func readTagDirs(fs *DocFS, parentID uint64) ([]fuse.Dirent, error) {
+	tags, err := fs.fsdb.GetChildTags(parentID)
+	if err != nil {
+		return nil, fuseError(err)
 	}
 
 	var children []fuse.Dirent
 	for _, tag := range tags {
 		children = append(children, fuse.Dirent{
-			Inode: t.fs.getInode(nTag, tag.ID),
+			Inode: fs.getInode(nTag, tag.ID),
 			Name:  tag.Name,
+			Type:  fuse.DT_Dir,
 		})
 	}
 
 	return children, nil
 }
 
-func (t *fsTags) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
-	id, err := t.fs.fsdb.AddTag(req.Name)
+func mkdirTag(fs *DocFS, parentID uint64, name string) (fusefs.Node, error) {
+	id, err := fs.fsdb.AddTag(parentID, name)
 	if err != nil {
-		return nil, err
+		return nil, fuseError(err)
 	}
 
-	return newFsTag(t.fs, id, req.Name), nil
+	return newFsTag(fs, id, name), nil
 }
 
-func (t *fsTags) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
-	foundTag, err := t.fs.fsdb.GetTag(name)
-	if err != nil {
-		return nil, err
-	}
-
-	if foundTag == nil {
-		return nil, fuse.ENOENT
+// tagParentID returns the ID of the tag a tag directory is, or 0 for the
+// top level tags directory.
+func tagParentID(dir fusefs.Node) (uint64, bool) {
+	switch dir := dir.(type) {
+	case *fsTags:
+		return 0, true
+	case *fsTag:
+		return dir.id, true
 	}
 
-	return newFsTag(t.fs, foundTag.ID, foundTag.Name), nil
+	return 0, false
 }
 
-func (t *fsTags) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if !req.Dir {
-		return fuse.EIO
+// renameTag renames a tag under parentID, moving it under the tag it's
+// renamed into. Renaming a tag over another tag merges the two.
+func renameTag(fs *DocFS, parentID uint64, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	newParentID, ok := tagParentID(newDir)
+	if !ok {
+		return fuse.EPERM
 	}
 
-	err := t.fs.fsdb.RemoveTag(req.Name)
-	if err != nil {
-		return err
+	tag, err := fs.fsdb.GetTag(parentID, req.OldName)
+	if err == db.ErrNotExists {
+		// Documents in a tag directory can't be renamed, only tags.
+		return fuse.EPERM
+	} else if err != nil {
+		return fuseError(err)
 	}
 
-	return nil
+	target, err := fs.fsdb.GetTag(newParentID, req.NewName)
+	if err == nil && target.ID != tag.ID {
+		return fuseError(fs.fsdb.MergeTag(tag.ID, target.ID))
+	} else if err != nil && err != db.ErrNotExists {
+		return fuseError(err)
+	}
+
+	return fuseError(fs.fsdb.MoveTag(tag.ID, newParentID, req.NewName))
 }
 
 type fsTag struct {
@@ -91,16 +144,165 @@ type fsTag struct {
 }
 
 func newFsTag(fs *DocFS, id uint64, name string) *fsTag {
-	t := &fsTag{
-		fs: fs,
-		id: id,
-	}
-	t.name = name
-	return t
+	inode := fs.getInode(nTag, id)
+	return fs.getNode(inode, func() fusefs.Node {
+		t := &fsTag{
+			fs: fs,
+			id: id,
+		}
+		t.name = name
+		t.inode = inode
+		return t
+	}).(*fsTag)
+}
+
+func (t *fsTag) Forget() {
+	t.fs.forgetNode(t.inode, t)
 }
 
 func (t *fsTag) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Inode = t.fs.getInode(nTag, t.id)
-	attr.Mode = os.ModeDir | 0755
+	tags, err := t.fs.fsdb.GetChildTags(t.id)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	t.fs.dirAttr(attr, t.inode, 0755, len(tags))
 	return nil
 }
+
+// getDoc returns the document listed in the tag directory under name.
+func (t *fsTag) getDoc(name string) (*db.Doc, error) {
+	return t.fs.fsdb.GetTagDocByName(t.id, name, t.fs.tagDescendants)
+}
+
+func (t *fsTag) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	children, err := readTagDirs(t.fs, t.id)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := t.fs.fsdb.GetTagDocs(t.id, t.fs.tagDescendants)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  doc.Filename,
+			Inode: t.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	for _, s := range t.fs.getTagScratches(t.id) {
+		children = append(children, fuse.Dirent{
+			Name:  s.name,
+			Inode: s.inode,
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+func (t *fsTag) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fusefs.Node, error) {
+	name := req.Name
+	if filter, ok, err := lookupTagFilter(t.fs, []uint64{t.id}, nil, name); ok {
+		return filter, fuseError(err)
+	}
+
+	tag, err := t.fs.fsdb.GetTag(t.id, name)
+	if err == nil {
+		return newFsTag(t.fs, tag.ID, tag.Name), nil
+	} else if err != db.ErrNotExists {
+		return nil, fuseError(err)
+	}
+
+	// Documents created in the tag's directory aren't in the database
+	// until they're closed, so the kernel shouldn't cache them.
+	if s := t.fs.getTagScratch(t.id, name); s != nil {
+		resp.EntryValid = 0
+		return s, nil
+	}
+
+	if revs, ok, err := lookupRevisions(t.fs, name, t.getDoc); ok {
+		return revs, fuseError(err)
+	}
+
+	doc, err := t.getDoc(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsDoc(t.fs, doc.ID, doc.Filename), nil
+}
+
+func (t *fsTag) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	return mkdirTag(t.fs, t.id, req.Name)
+}
+
+func (t *fsTag) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	return renameTag(t.fs, t.id, req, newDir)
+}
+
+func (t *fsTag) Link(ctx context.Context, req *fuse.LinkRequest, old fusefs.Node) (fusefs.Node, error) {
+	doc, ok := old.(*fsDoc)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+
+	err := t.fs.fsdb.TagDoc(t.id, doc.ID)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return doc, nil
+}
+
+func (t *fsTag) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	curTime := t.fs.clock.Now()
+
+	y := uint64(curTime.Year())
+	m := uint64(curTime.Month())
+	day := uint64(curTime.Day())
+
+	err := t.fs.fsdb.AddDay(y, m, day)
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
+
+	doc, err := createScratchDoc(t.fs, req.Name, y, m, day, t.id)
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
+
+	handle, err := doc.newHandle()
+	if err != nil {
+		return nil, nil, fuseError(err)
+	}
+
+	resp.EntryValid = 0
+	return doc, handle, nil
+}
+
+func (t *fsTag) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return fuseError(t.fs.fsdb.RemoveTag(t.id, req.Name, t.fs.clock.Now()))
+	}
+
+	doc, err := t.fs.fsdb.GetTagDocByName(t.id, req.Name, false)
+	if err == db.ErrNotExists && t.fs.tagDescendants {
+		// Documents listed from a nested tag have to be removed from
+		// the tag they're actually in.
+		if _, err := t.getDoc(req.Name); err == nil {
+			return fuse.EPERM
+		}
+	}
+	if err != nil {
+		return fuseError(err)
+	}
+
+	// Removing a document from a tag directory only untags it, the
+	// document itself stays filed under its date.
+	return fuseError(t.fs.fsdb.UntagDoc(t.id, doc.ID))
+}
@@ -0,0 +1,370 @@
+package dfs
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+// purgeInterval is the longest time between checks for trash entries older
+// than the purge age.
+const purgeInterval = time.Hour
+
+// purgeTrash permanently removes trash entries older than the purge age.
+func (f *DocFS) purgeTrash() error {
+	purged, err := f.fsdb.PurgeTrash(f.clock.Now().Add(-f.purgeAge))
+	if err != nil {
+		return err
+	}
+
+	return removeDocFiles(f, purged)
+}
+
+func (f *DocFS) purgeLoop() {
+	defer close(f.purgeDone)
+
+	interval := purgeInterval
+	if f.purgeAge < interval {
+		interval = f.purgeAge
+	}
+
+	for {
+		select {
+		case <-f.stopPurge:
+			return
+		case <-f.clock.After(interval):
+		}
+
+		err := f.purgeTrash()
+		if err != nil {
+			debugf("could not purge trash: %s", err)
+		}
+	}
+}
+
+// fsTrash holds documents and tags that have been removed. Moving an entry
+// out of the trash restores it and removing an entry from the trash removes
+// it permanently.
+type fsTrash struct {
+	node
+
+	fs   *DocFS
+	docs *fsTrashDocs
+	tags *fsTrashTags
+}
+
+func newFsTrash(fs *DocFS) *fsTrash {
+	t := &fsTrash{
+		fs:   fs,
+		docs: newFsTrashDocs(fs),
+		tags: newFsTrashTags(fs),
+	}
+	t.inode = fs.getInode(nTrash, 0)
+	t.name = "trash"
+
+	return t
+}
+
+func (t *fsTrash) Attr(ctx context.Context, attr *fuse.Attr) error {
+	t.fs.dirAttr(attr, t.inode, 0755, 2)
+	return nil
+}
+
+func (t *fsTrash) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var children []fuse.Dirent
+	children = append(children, fuse.Dirent{
+		Inode: t.tags.inode,
+		Name:  "tags",
+	})
+	children = append(children, fuse.Dirent{
+		Inode: t.docs.inode,
+		Name:  "documents",
+	})
+	return children, nil
+}
+
+func (t *fsTrash) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	if name == "tags" {
+		return t.tags, nil
+	} else if name == "documents" {
+		return t.docs, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// fsTrashDocs lists the documents in the trash. Documents from different
+// days can have the same name so each one is prefixed with its ID.
+type fsTrashDocs struct {
+	node
+
+	fs *DocFS
+}
+
+func newFsTrashDocs(fs *DocFS) *fsTrashDocs {
+	t := &fsTrashDocs{
+		fs: fs,
+	}
+	t.inode = fs.getInode(nTrashDocs, 0)
+	t.name = "documents"
+
+	return t
+}
+
+func (t *fsTrashDocs) Attr(ctx context.Context, attr *fuse.Attr) error {
+	t.fs.dirAttr(attr, t.inode, 0755, 0)
+	return nil
+}
+
+func (t *fsTrashDocs) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	docs, err := t.fs.fsdb.GetTrashedDocs()
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  idName(doc.ID, doc.Filename),
+			Inode: t.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+// getDoc returns the trashed document for a name in the trash.
+func (t *fsTrashDocs) getDoc(name string) (*db.Doc, error) {
+	id, ok := parseIDName(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	doc, err := t.fs.fsdb.GetDoc(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.Deleted.IsZero() || idName(doc.ID, doc.Filename) != name {
+		return nil, fuse.ENOENT
+	}
+
+	return doc, nil
+}
+
+func (t *fsTrashDocs) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	doc, err := t.getDoc(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsDoc(t.fs, doc.ID, doc.Filename), nil
+}
+
+func (t *fsTrashDocs) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return fuse.ENOENT
+	}
+
+	doc, err := t.getDoc(req.Name)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	purged, err := t.fs.fsdb.PurgeDoc(doc.ID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	return fuseError(removeDocFiles(t.fs, purged))
+}
+
+// Rename restores a document by moving it into a day directory, where it's
+// filed under the new name.
+func (t *fsTrashDocs) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	day, ok := newDir.(*fsDay)
+	if !ok {
+		return fuse.EPERM
+	}
+
+	doc, err := t.getDoc(req.OldName)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	_, err = t.fs.fsdb.GetDocByName(day.Year, day.Month, day.Day, req.NewName)
+	if err == nil {
+		return fuse.EEXIST
+	} else if err != db.ErrNotExists {
+		return fuseError(err)
+	}
+
+	err = t.fs.fsdb.RestoreDoc(doc.ID, day.Year, day.Month, day.Day, req.NewName)
+	return fuseError(err)
+}
+
+// fsTrashTags lists the tags in the trash. Tags under different parents can
+// have the same name so each one is prefixed with its ID.
+type fsTrashTags struct {
+	node
+
+	fs *DocFS
+}
+
+func newFsTrashTags(fs *DocFS) *fsTrashTags {
+	t := &fsTrashTags{
+		fs: fs,
+	}
+	t.inode = fs.getInode(nTrashTags, 0)
+	t.name = "tags"
+
+	return t
+}
+
+func (t *fsTrashTags) Attr(ctx context.Context, attr *fuse.Attr) error {
+	tags, err := t.fs.fsdb.GetTrashedTags()
+	if err != nil {
+		return fuseError(err)
+	}
+
+	t.fs.dirAttr(attr, t.inode, 0755, len(tags))
+	return nil
+}
+
+func (t *fsTrashTags) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	tags, err := t.fs.fsdb.GetTrashedTags()
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, tag := range tags {
+		children = append(children, fuse.Dirent{
+			Inode: t.fs.getInode(nTrashTag, tag.ID),
+			Name:  idName(tag.ID, tag.Name),
+			Type:  fuse.DT_Dir,
+		})
+	}
+
+	return children, nil
+}
+
+// getTag returns the trashed tag for a name in the trash.
+func (t *fsTrashTags) getTag(name string) (*db.Tag, error) {
+	id, ok := parseIDName(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	tag, err := t.fs.fsdb.GetTrashedTag(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if idName(tag.ID, tag.Name) != name {
+		return nil, fuse.ENOENT
+	}
+
+	return tag, nil
+}
+
+func (t *fsTrashTags) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	tag, err := t.getTag(name)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	return newFsTrashTag(t.fs, tag.ID, name), nil
+}
+
+func (t *fsTrashTags) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !req.Dir {
+		return errIsDir
+	}
+
+	tag, err := t.getTag(req.Name)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	return fuseError(t.fs.fsdb.PurgeTag(tag.ID))
+}
+
+// Rename restores a tag by moving it into the tags directory, or another
+// tag's directory, under the new name.
+func (t *fsTrashTags) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	parentID, ok := tagParentID(newDir)
+	if !ok {
+		return fuse.EPERM
+	}
+
+	tag, err := t.getTag(req.OldName)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	return fuseError(t.fs.fsdb.RestoreTag(tag.ID, parentID, req.NewName))
+}
+
+// fsTrashTag is a read only view of the documents in the trash that still
+// have a tag in the trash. They're named the same way as in the documents
+// directory of the trash so they can be found there to be restored.
+type fsTrashTag struct {
+	node
+
+	fs *DocFS
+
+	id uint64
+}
+
+func newFsTrashTag(fs *DocFS, id uint64, name string) *fsTrashTag {
+	t := &fsTrashTag{
+		fs: fs,
+		id: id,
+	}
+	t.inode = fs.getInode(nTrashTag, id)
+	t.name = name
+
+	return t
+}
+
+func (t *fsTrashTag) Attr(ctx context.Context, attr *fuse.Attr) error {
+	t.fs.dirAttr(attr, t.inode, 0555, 0)
+	return nil
+}
+
+func (t *fsTrashTag) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	docs, err := t.fs.fsdb.GetTrashedTagDocs(t.id)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	var children []fuse.Dirent
+	for _, doc := range docs {
+		children = append(children, fuse.Dirent{
+			Name:  idName(doc.ID, doc.Filename),
+			Inode: t.fs.getInode(nDoc, doc.ID),
+			Type:  fuse.DT_File,
+		})
+	}
+
+	return children, nil
+}
+
+func (t *fsTrashTag) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	docs, err := t.fs.fsdb.GetTrashedTagDocs(t.id)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	for _, doc := range docs {
+		if idName(doc.ID, doc.Filename) == name {
+			return newFsDoc(t.fs, doc.ID, doc.Filename), nil
+		}
+	}
+
+	return nil, fuse.ENOENT
+}
@@ -0,0 +1,145 @@
+package dfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aphistic/docfs/dfs/db"
+	"golang.org/x/net/context"
+)
+
+// Document metadata is exposed as extended attributes under xattrPrefix.
+// The checksum, creation time and date the document is filed under can only
+// be read, setting the tags retags the document and the title and meta
+// attributes are stored as they're set.
+const (
+	xattrPrefix   = "user.docfs."
+	xattrSHA256   = xattrPrefix + "sha256"
+	xattrTags     = xattrPrefix + "tags"
+	xattrCreated  = xattrPrefix + "created"
+	xattrDate     = xattrPrefix + "date"
+	xattrTitle    = xattrPrefix + "title"
+	xattrMetaBase = xattrPrefix + "meta."
+)
+
+// tagSeparator separates tag paths in the tags attribute.
+const tagSeparator = ","
+
+// metaKey returns the key an attribute is stored under in the document's
+// metadata, or false if the attribute isn't stored as metadata.
+func metaKey(name string) (string, bool) {
+	if name == xattrTitle || strings.HasPrefix(name, xattrMetaBase) {
+		return strings.TrimPrefix(name, xattrPrefix), true
+	}
+
+	return "", false
+}
+
+func (d *fsDoc) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	switch req.Name {
+	case xattrSHA256, xattrCreated, xattrDate:
+		doc, err := d.fs.fsdb.GetDoc(d.ID)
+		if err != nil {
+			return fuseError(err)
+		}
+
+		switch req.Name {
+		case xattrSHA256:
+			resp.Xattr = []byte(doc.Checksum)
+		case xattrCreated:
+			resp.Xattr = []byte(doc.Created.Format(time.RFC3339))
+		case xattrDate:
+			resp.Xattr = []byte(fmt.Sprintf("%04d-%02d-%02d", doc.Year, doc.Month, doc.Day))
+		}
+		return nil
+	case xattrTags:
+		tags, err := d.fs.fsdb.GetDocTags(d.ID)
+		if err != nil {
+			return fuseError(err)
+		}
+
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Path)
+		}
+		resp.Xattr = []byte(strings.Join(names, tagSeparator))
+		return nil
+	}
+
+	key, ok := metaKey(req.Name)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	value, err := d.fs.fsdb.GetDocMetaValue(d.ID, key)
+	if err == db.ErrNotExists {
+		return fuse.ErrNoXattr
+	} else if err != nil {
+		return fuseError(err)
+	}
+
+	resp.Xattr = value
+	return nil
+}
+
+func (d *fsDoc) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append(xattrSHA256, xattrTags, xattrCreated, xattrDate)
+
+	meta, err := d.fs.fsdb.GetDocMeta(d.ID)
+	if err != nil {
+		return fuseError(err)
+	}
+
+	for _, m := range meta {
+		resp.Append(xattrPrefix + m.Key)
+	}
+
+	return nil
+}
+
+func (d *fsDoc) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	switch req.Name {
+	case xattrSHA256, xattrCreated, xattrDate:
+		return fuse.EPERM
+	case xattrTags:
+		var names []string
+		for _, name := range strings.Split(string(req.Xattr), tagSeparator) {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		return fuseError(d.fs.fsdb.SetDocTags(d.ID, names))
+	}
+
+	key, ok := metaKey(req.Name)
+	if !ok || key == "meta." {
+		return errNotSup
+	}
+
+	return fuseError(d.fs.fsdb.SetDocMeta(d.ID, key, req.Xattr))
+}
+
+func (d *fsDoc) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	switch req.Name {
+	case xattrSHA256, xattrCreated, xattrDate:
+		return fuse.EPERM
+	case xattrTags:
+		return fuseError(d.fs.fsdb.SetDocTags(d.ID, nil))
+	}
+
+	key, ok := metaKey(req.Name)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	err := d.fs.fsdb.RemoveDocMeta(d.ID, key)
+	if err == db.ErrNotExists {
+		return fuse.ErrNoXattr
+	}
+
+	return fuseError(err)
+}
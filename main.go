@@ -3,58 +3,138 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
 
 	"bazil.org/fuse"
-	fusefs "bazil.org/fuse/fs"
 	"github.com/aphistic/docfs/dfs"
+	"github.com/urfave/cli"
 )
 
-const (
-	mountRoot = "/home/aphistic/tmp/docfs"
-	docRoot   = "/home/aphistic/tmp/docroot"
-)
+// debugFlag turns on debug messages for a command.
+var debugFlag = cli.BoolFlag{
+	Name:  "debug",
+	Usage: "Log debug messages",
+}
 
 func main() {
-	fuse.Debug = func(msg interface{}) { fmt.Println(msg) }
+	app := cli.NewApp()
+	app.Name = "docfs"
+	app.Usage = "A filesystem designed to make it easier to organize documents"
+	app.Commands = []cli.Command{
+		{
+			Name:      "init",
+			Usage:     "Create a new docfs root",
+			ArgsUsage: "<root>",
+			Action:    runInit,
+		},
+		{
+			Name:      "mount",
+			Usage:     "Mount a docfs root",
+			ArgsUsage: "<root> <mountpoint>",
+			Flags: []cli.Flag{
+				debugFlag,
+				cli.BoolFlag{
+					Name:  "allow-other",
+					Usage: "Allow other users to access the mount",
+				},
+				cli.BoolFlag{
+					Name:  "read-only",
+					Usage: "Mount the filesystem read-only",
+				},
+				cli.BoolFlag{
+					Name:  "cascade-remove",
+					Usage: "Remove documents along with the date directories they're filed under",
+				},
+				cli.BoolFlag{
+					Name:  "tag-descendants",
+					Usage: "List the documents of nested tags in their parent tag directories too",
+				},
+				cli.IntFlag{
+					Name:  "uid",
+					Usage: "Owner of every file and directory, instead of the current user",
+				},
+				cli.IntFlag{
+					Name:  "gid",
+					Usage: "Group of every file and directory, instead of the current group",
+				},
+				cli.DurationFlag{
+					Name:  "purge-age",
+					Usage: "Permanently remove trash entries older than this, such as 720h",
+				},
+				cli.StringSliceFlag{
+					Name:  "extract-command",
+					Usage: "Index documents of a MIME type with the output of a command, such as 'application/pdf=pdftotext - -'",
+				},
+			},
+			Action: runMount,
+		},
+		{
+			Name:      "unmount",
+			Usage:     "Unmount a mounted docfs",
+			ArgsUsage: "<mountpoint>",
+			Action:    runUnmount,
+		},
+		{
+			Name:  "admin",
+			Usage: "Inspect and manage a docfs root without mounting it",
+			Subcommands: []cli.Command{
+				{
+					Name:      "tags",
+					Usage:     "List all tags",
+					ArgsUsage: "<root>",
+					Flags:     []cli.Flag{debugFlag},
+					Action:    runAdminTags,
+				},
+				{
+					Name:      "add-tag",
+					Usage:     "Add a tag, along with its parents for a path like finance/taxes",
+					ArgsUsage: "<root> <tag>",
+					Flags:     []cli.Flag{debugFlag},
+					Action:    runAdminAddTag,
+				},
+				{
+					Name:      "remove-tag",
+					Usage:     "Move a tag without documents or nested tags to the trash",
+					ArgsUsage: "<root> <tag>",
+					Flags:     []cli.Flag{debugFlag},
+					Action:    runAdminRemoveTag,
+				},
+				{
+					Name:      "docs",
+					Usage:     "List all documents",
+					ArgsUsage: "<root>",
+					Flags:     []cli.Flag{debugFlag},
+					Action:    runAdminDocs,
+				},
+			},
+		},
+	}
 
-	fs, err := dfs.NewDocFS(docRoot)
+	err := app.Run(os.Args)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "docfs root '%s' could not be opened: %s\n",
-			docRoot, err)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
-	defer fs.Close()
+}
 
-	c, err := fuse.Mount(mountRoot)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't mount fs: %s\n", err)
-		os.Exit(1)
+// enableDebug logs debug messages to stdout if the command was given the
+// debug flag.
+func enableDebug(c *cli.Context) {
+	if !c.Bool("debug") {
+		return
 	}
-	defer c.Close()
-
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT)
-
-	serveChan := make(chan error, 1)
-	go func() {
-		serveChan <- fusefs.Serve(c, fs)
-	}()
-
-	select {
-	case err := <-serveChan:
-		if err != nil {
-			fmt.Printf("Error running serve: %s\n", err)
-		}
-	case sig := <-sigChan:
-		fmt.Printf("Signal %s received, stopping\n", sig)
-		fuse.Unmount(mountRoot)
+
+	fuse.Debug = func(msg interface{}) { fmt.Println(msg) }
+	dfs.Debug = func(msg interface{}) { fmt.Println(msg) }
+}
+
+// requireArgs makes sure a command was given exactly count arguments,
+// showing the command's help if it wasn't.
+func requireArgs(c *cli.Context, count int) error {
+	if c.NArg() != count {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return fmt.Errorf("%s expects %d argument(s), got %d",
+			c.Command.Name, count, c.NArg())
 	}
 
-	time.AfterFunc(2*time.Second, func() {
-		fmt.Printf("Exiting timed out, exiting with error\n")
-		os.Exit(1)
-	})
+	return nil
 }
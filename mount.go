@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aphistic/docfs/dfs"
+	"github.com/urfave/cli"
+)
+
+const unmountTimeout = 2 * time.Second
+
+func runInit(c *cli.Context) error {
+	err := requireArgs(c, 1)
+	if err != nil {
+		return err
+	}
+
+	docRoot := c.Args().Get(0)
+	err = dfs.InitDocFS(docRoot)
+	if err != nil {
+		return fmt.Errorf("docfs root '%s' could not be created: %s",
+			docRoot, err)
+	}
+
+	return nil
+}
+
+func runMount(c *cli.Context) error {
+	err := requireArgs(c, 2)
+	if err != nil {
+		return err
+	}
+
+	docRoot := c.Args().Get(0)
+	mountRoot := c.Args().Get(1)
+
+	enableDebug(c)
+
+	mountOpts := []fuse.MountOption{
+		fuse.FSName("docfs"),
+		fuse.Subtype("docfs"),
+	}
+	if c.Bool("allow-other") {
+		mountOpts = append(mountOpts, fuse.AllowOther())
+	}
+	if c.Bool("read-only") {
+		mountOpts = append(mountOpts, fuse.ReadOnly())
+	}
+
+	var fsOpts []dfs.Option
+	if c.Bool("cascade-remove") {
+		fsOpts = append(fsOpts, dfs.CascadeRemove())
+	}
+	if c.Bool("tag-descendants") {
+		fsOpts = append(fsOpts, dfs.TagDescendants())
+	}
+	if c.IsSet("uid") || c.IsSet("gid") {
+		uid := uint32(os.Getuid())
+		if c.IsSet("uid") {
+			uid = uint32(c.Int("uid"))
+		}
+		gid := uint32(os.Getgid())
+		if c.IsSet("gid") {
+			gid = uint32(c.Int("gid"))
+		}
+		fsOpts = append(fsOpts, dfs.Owner(uid, gid))
+	}
+	if purgeAge := c.Duration("purge-age"); purgeAge > 0 {
+		fsOpts = append(fsOpts, dfs.PurgeAge(purgeAge))
+	}
+	for _, extract := range c.StringSlice("extract-command") {
+		parts := strings.SplitN(extract, "=", 2)
+		var command []string
+		if len(parts) == 2 {
+			command = strings.Fields(parts[1])
+		}
+		if parts[0] == "" || len(command) == 0 {
+			return fmt.Errorf("extract command '%s' should look like <type>=<command>",
+				extract)
+		}
+
+		fsOpts = append(fsOpts, dfs.ExtractCommand(parts[0], command[0], command[1:]...))
+	}
+
+	fs, err := dfs.NewDocFS(docRoot, fsOpts...)
+	if err != nil {
+		return fmt.Errorf("docfs root '%s' could not be opened: %s",
+			docRoot, err)
+	}
+	defer fs.Close()
+
+	conn, err := fuse.Mount(mountRoot, mountOpts...)
+	if err != nil {
+		return fmt.Errorf("Couldn't mount fs: %s", err)
+	}
+	defer conn.Close()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	serveChan := make(chan error, 1)
+	go func() {
+		serveChan <- fs.Serve(conn)
+	}()
+
+	select {
+	case err := <-serveChan:
+		if err != nil {
+			return fmt.Errorf("Error running serve: %s", err)
+		}
+		return nil
+	case sig := <-sigChan:
+		fmt.Printf("Signal %s received, stopping\n", sig)
+		err = fuse.Unmount(mountRoot)
+		if err != nil {
+			return fmt.Errorf("Couldn't unmount fs: %s", err)
+		}
+	}
+
+	select {
+	case <-serveChan:
+	case <-time.After(unmountTimeout):
+		return fmt.Errorf("Timed out waiting for fs to stop")
+	}
+
+	return nil
+}
+
+func runUnmount(c *cli.Context) error {
+	err := requireArgs(c, 1)
+	if err != nil {
+		return err
+	}
+
+	mountRoot := c.Args().Get(0)
+	err = fuse.Unmount(mountRoot)
+	if err != nil {
+		return fmt.Errorf("Couldn't unmount fs: %s", err)
+	}
+
+	return nil
+}